@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// openAppendFS is a file system which can open a file to append. used to write audit_log.
+type openAppendFS interface {
+	fs.FS
+	OpenAppend(name string) (io.WriteCloser, error)
+}
+
+// auditRecord is a line of audit_log.
+type auditRecord struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client"`
+	User       string    `json:"user"`
+	Database   string    `json:"database"`
+	Connection string    `json:"connection"`
+
+	// query, parse, bind, complete or error.
+	Event string `json:"event"`
+	// prepared statement name of parse and bind.
+	Statement  string   `json:"statement,omitempty"`
+	SQL        string   `json:"sql,omitempty"`
+	Params     *int     `json:"params,omitempty"`
+	Tag        string   `json:"tag,omitempty"`
+	Code       string   `json:"code,omitempty"`
+	Message    string   `json:"message,omitempty"`
+	DurationMs *float64 `json:"duration_ms,omitempty"`
+}
+
+// auditStart is a message whose completion is awaited. Query, Execute or Sync.
+type auditStart struct {
+	header byte
+	at     time.Time
+}
+
+// auditLog records statements of a session.
+type auditLog struct {
+	write   func(line []byte) error
+	session auditRecord
+
+	mu      sync.Mutex
+	pending []auditStart
+}
+
+func newAuditLog(write func(line []byte) error, client, user, database, connection string) *auditLog {
+	return &auditLog{
+		write: write,
+		session: auditRecord{
+			Client:     client,
+			User:       user,
+			Database:   database,
+			Connection: connection,
+		},
+	}
+}
+
+func (a *auditLog) log(r auditRecord) error {
+	r.Time = time.Now()
+	r.Client = a.session.Client
+	r.User = a.session.User
+	r.Database = a.session.Database
+	r.Connection = a.session.Connection
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return a.write(append(b, '\n'))
+}
+
+func (a *auditLog) start(header byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending = append(a.pending, auditStart{header, time.Now()})
+}
+
+// complete returns duration of the running command. nil if unknown.
+func (a *auditLog) complete() *float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.pending) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	head := &a.pending[0]
+	ms := float64(now.Sub(head.at)) / float64(time.Millisecond)
+	if head.header == 'E' {
+		a.pending = a.pending[1:]
+	} else {
+		// next statement of the same Query starts now.
+		head.at = now
+	}
+	return &ms
+}
+
+// ready forgets starts until Query or Sync answered by ReadyForQuery.
+func (a *auditLog) ready() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for len(a.pending) > 0 {
+		head := a.pending[0]
+		a.pending = a.pending[1:]
+		if head.header != 'E' {
+			return
+		}
+	}
+}
+
+// frontend records Query, Parse and Bind. passwords are never recorded.
+func (a *auditLog) frontend(next messageHandler) messageHandler {
+	return func(w io.Writer, pkt *rawPacket) error {
+		switch pkt.header {
+		case 'Q':
+			sql, err := readString(bytes.NewBuffer(pkt.data))
+			if err != nil {
+				return err
+			}
+			a.start(pkt.header)
+			if err := a.log(auditRecord{Event: "query", SQL: sql}); err != nil {
+				return err
+			}
+
+		case 'P':
+			b := bytes.NewBuffer(pkt.data)
+			name, err := readString(b)
+			if err != nil {
+				return err
+			}
+			sql, err := readString(b)
+			if err != nil {
+				return err
+			}
+			if err := a.log(auditRecord{Event: "parse", Statement: name, SQL: sql}); err != nil {
+				return err
+			}
+
+		case 'B':
+			b := bytes.NewBuffer(pkt.data)
+			if _, err := readString(b); err != nil {
+				return err
+			}
+			name, err := readString(b)
+			if err != nil {
+				return err
+			}
+			// format codes precede parameters.
+			formats, err := read16(b)
+			if err != nil {
+				return err
+			}
+			b.Next(int(formats) * 2)
+			params, err := read16(b)
+			if err != nil {
+				return err
+			}
+			n := int(params)
+			if err := a.log(auditRecord{Event: "bind", Statement: name, Params: &n}); err != nil {
+				return err
+			}
+
+		case 'E', 'S':
+			a.start(pkt.header)
+		}
+		return next(w, pkt)
+	}
+}
+
+// backend records CommandComplete and ErrorResponse with durations.
+func (a *auditLog) backend(next messageHandler) messageHandler {
+	return func(w io.Writer, pkt *rawPacket) error {
+		switch pkt.header {
+		case 'C':
+			tag, err := readString(bytes.NewBuffer(pkt.data))
+			if err != nil {
+				return err
+			}
+			if err := a.log(auditRecord{Event: "complete", Tag: tag, DurationMs: a.complete()}); err != nil {
+				return err
+			}
+
+		case 'E':
+			e, err := parseErrorResponse(pkt)
+			if err != nil {
+				return err
+			}
+			if err := a.log(auditRecord{Event: "error", Code: e.get('C'), Message: e.get('M'), DurationMs: a.complete()}); err != nil {
+				return err
+			}
+
+		case 'I', 's':
+			// EmptyQueryResponse and PortalSuspended end the command too.
+			a.complete()
+
+		case 'Z':
+			a.ready()
+		}
+		return next(w, pkt)
+	}
+}
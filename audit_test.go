@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	lines := &bytes.Buffer{}
+	audit := newAuditLog(func(line []byte) error {
+		lines.Write(line)
+		return nil
+	}, "[::1]:50000", "alice", "prod", "prod")
+
+	bind := &bytes.Buffer{}
+	must(writeString(bind, ""))
+	must(writeString(bind, "s1"))
+	bind.Write([]byte{0, 1, 0, 0, 0, 2, 0, 0, 0, 1, '1', 0, 0, 0, 1, '2', 0, 0})
+
+	up := &bytes.Buffer{}
+	frontend := audit.frontend(writeMessage)
+	for _, pkt := range []rawPacket{
+		newTestQuery("SELECT 1; SELECT 2"),
+		newTestParse("SELECT $1 + $2"),
+		{'B', bind.Bytes()},
+		{'E', []byte{0, 0, 0, 0, 0}},
+		{'S', nil},
+		{'p', []byte("secret\x00")},
+	} {
+		if err := frontend(up, &pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errorPkt := (&errorResponse{fields: []errorResponseField{{'S', "ERROR"}, {'C', "42P01"}, {'M', "relation does not exist"}}}).toRaw()
+	client := &bytes.Buffer{}
+	backend := audit.backend(writeMessage)
+	for _, pkt := range []rawPacket{
+		{'C', []byte("SELECT 1\x00")},
+		{'C', []byte("SELECT 1\x00")},
+		{'Z', []byte{'I'}},
+		{'1', nil},
+		{'2', nil},
+		errorPkt,
+		{'Z', []byte{'I'}},
+	} {
+		if err := backend(client, &pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// relayed as is.
+	if n := len(testReadPackets(t, up)); n != 6 {
+		t.Fatalf("%d != 6", n)
+	}
+	if n := len(testReadPackets(t, client)); n != 7 {
+		t.Fatalf("%d != 7", n)
+	}
+
+	var records []auditRecord
+	s := bufio.NewScanner(lines)
+	for s.Scan() {
+		var r auditRecord
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Client != "[::1]:50000" || r.User != "alice" || r.Database != "prod" || r.Connection != "prod" || r.Time.IsZero() {
+			t.Fatalf("%#v", r)
+		}
+		records = append(records, r)
+	}
+
+	wants := []struct {
+		event    string
+		sql      string
+		params   int
+		tag      string
+		code     string
+		duration bool
+	}{
+		{event: "query", sql: "SELECT 1; SELECT 2"},
+		{event: "parse", sql: "SELECT $1 + $2"},
+		{event: "bind", params: 2},
+		{event: "complete", tag: "SELECT 1", duration: true},
+		{event: "complete", tag: "SELECT 1", duration: true},
+		{event: "error", code: "42P01", duration: true},
+	}
+	if len(records) != len(wants) {
+		t.Fatalf("%d != %d: %s", len(records), len(wants), lines)
+	}
+	for i, w := range wants {
+		r := records[i]
+		params := 0
+		if r.Params != nil {
+			params = *r.Params
+		}
+		if r.Event != w.event || r.SQL != w.sql || params != w.params || r.Tag != w.tag || r.Code != w.code || (r.DurationMs != nil) != w.duration {
+			t.Fatalf("%d: %#v", i, r)
+		}
+	}
+	if len(audit.pending) != 0 {
+		t.Fatal(audit.pending)
+	}
+}
+
+// testAuditFs is testDialSshTunnelFs which records opens of audit_log.
+type testAuditFs struct {
+	testDialSshTunnelFs
+
+	mu     sync.Mutex
+	opens  int
+	closes int
+	lines  bytes.Buffer
+}
+
+type testAuditFile struct {
+	fs *testAuditFs
+}
+
+func (f testAuditFile) Write(b []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.fs.lines.Write(b)
+}
+
+func (f testAuditFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.fs.closes++
+	return nil
+}
+
+func (v *testAuditFs) OpenAppend(name string) (io.WriteCloser, error) {
+	if name != "/audit.log" {
+		return nil, fmt.Errorf("unexpected %s", name)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.opens++
+	return testAuditFile{v}, nil
+}
+
+func TestServeAuditLog(t *testing.T) {
+	pg := startTestPostgres(t, handleTestPostgresReady)
+	s := newTestServer(startTestSshJumpServer(t), map[string]*Connection{
+		"db": {
+			Addr:     pg,
+			Dbname:   "db",
+			AuditLog: "/audit.log",
+		},
+	})
+	fsys := &testAuditFs{testDialSshTunnelFs: s.config.fs.(testDialSshTunnelFs)}
+	s.config.fs = fsys
+
+	client, conn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer conn.Close()
+		s.serve(context.Background(), conn, "")
+	}()
+
+	startup := (&startupMessage{map[string]string{"database": "db", "user": "guest"}}).toRaw()
+	if err := startup.write(client); err != nil {
+		t.Fatal(err)
+	}
+	for _, wants := range []byte("RZ") {
+		var pkt rawPacket
+		if err := pkt.read(client, noMessageSizeLimit); err != nil {
+			t.Fatal(err)
+		}
+		if pkt.header != wants {
+			t.Fatalf("%c != %c", pkt.header, wants)
+		}
+	}
+	for _, q := range []string{"SELECT 1", "SELECT 2", "SELECT 3"} {
+		pkt := newTestQuery(q)
+		if err := pkt.write(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.Close()
+	<-done
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if fsys.opens != 1 || fsys.closes != 1 {
+		t.Fatalf("opens %d, closes %d", fsys.opens, fsys.closes)
+	}
+	if n := strings.Count(fsys.lines.String(), "\n"); n != 3 {
+		t.Fatalf("%d != 3: %s", n, fsys.lines.String())
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+type cancelTarget struct {
+	entry *Connection
+	key   backendKeyData
+}
+
+// cancelRegistry maps the synthetic BackendKeyData handed to clients to the
+// connection entry and the real key of the upstream backend.
+type cancelRegistry struct {
+	mu      sync.Mutex
+	targets map[backendKeyData]cancelTarget
+}
+
+func newCancelRegistry() *cancelRegistry {
+	return &cancelRegistry{
+		targets: map[backendKeyData]cancelTarget{},
+	}
+}
+
+func randomBackendKeyData() backendKeyData {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return backendKeyData{
+		pid:    binary.BigEndian.Uint32(b[0:4]),
+		secret: binary.BigEndian.Uint32(b[4:8]),
+	}
+}
+
+func (r *cancelRegistry) register(entry *Connection, key backendKeyData) backendKeyData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for {
+		synthetic := randomBackendKeyData()
+		if _, exists := r.targets[synthetic]; exists {
+			continue
+		}
+		r.targets[synthetic] = cancelTarget{
+			entry: entry,
+			key:   key,
+		}
+		return synthetic
+	}
+}
+
+func (r *cancelRegistry) unregister(synthetic backendKeyData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.targets, synthetic)
+}
+
+func (r *cancelRegistry) lookup(synthetic backendKeyData) (cancelTarget, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, exists := r.targets[synthetic]
+	return t, exists
+}
+
+// relayBackendKeyData relays backend messages rewriting BackendKeyData by rewrite.
+// hands over to rest after the first ReadyForQuery.
+func relayBackendKeyData(dst io.Writer, src io.Reader, rewrite func(backendKeyData) backendKeyData, rest relay) error {
+	for {
+		var pkt rawPacket
+		if err := pkt.read(src, noMessageSizeLimit); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if pkt.header == 'K' {
+			key, err := parseBackendKeyData(&pkt)
+			if err != nil {
+				return err
+			}
+			synthetic := rewrite(*key)
+			pkt = synthetic.toRaw()
+		}
+		if err := pkt.write(dst); err != nil {
+			return err
+		}
+
+		if pkt.header == 'Z' {
+			return rest(dst, src)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRelayBackendKeyData(t *testing.T) {
+	src := &bytes.Buffer{}
+	for _, pkt := range []rawPacket{
+		{'R', []byte{0, 0, 0, 0}},
+		(&backendKeyData{1, 2}).toRaw(),
+		{'Z', []byte{'I'}},
+		(&backendKeyData{3, 4}).toRaw(),
+	} {
+		if err := pkt.write(src); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wants := &bytes.Buffer{}
+	for _, pkt := range []rawPacket{
+		{'R', []byte{0, 0, 0, 0}},
+		(&backendKeyData{9, 9}).toRaw(),
+		{'Z', []byte{'I'}},
+		// not rewritten after ReadyForQuery.
+		(&backendKeyData{3, 4}).toRaw(),
+	} {
+		if err := pkt.write(wants); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var keys []backendKeyData
+	dst := &bytes.Buffer{}
+	err := relayBackendKeyData(dst, src, func(key backendKeyData) backendKeyData {
+		keys = append(keys, key)
+		return backendKeyData{9, 9}
+	}, copyRelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dst.Bytes(), wants.Bytes()) {
+		t.Fatalf("%#v != %#v", dst.Bytes(), wants.Bytes())
+	}
+	if !reflect.DeepEqual(keys, []backendKeyData{{1, 2}}) {
+		t.Fatal(keys)
+	}
+}
+
+func TestServeCancelRequest(t *testing.T) {
+	backend := backendKeyData{1234, 5678}
+	cancelled := make(chan backendKeyData, 1)
+	pg := startTestPostgres(t, func(conn net.Conn) {
+		var pkt rawInitialPacket
+		if err := pkt.read(conn); err != nil {
+			return
+		}
+		p, err := pkt.toConcrete()
+		if err != nil {
+			return
+		}
+
+		switch p := p.(type) {
+		case *startupMessage:
+			for _, raw := range []rawPacket{
+				{'R', []byte{0, 0, 0, 0}},
+				backend.toRaw(),
+				{'Z', []byte{'I'}},
+			} {
+				if err := raw.write(conn); err != nil {
+					return
+				}
+			}
+			io.Copy(io.Discard, conn)
+		case *cancelRequest:
+			cancelled <- backendKeyData{p.pid, p.secret}
+		}
+	})
+
+	s := newTestServer(startTestSshJumpServer(t), map[string]*Connection{
+		"db": {
+			Addr:   pg,
+			Dbname: "db",
+		},
+	})
+
+	client := testServe(t, s)
+	startup := (&startupMessage{map[string]string{"database": "db", "user": "guest"}}).toRaw()
+	if err := startup.write(client); err != nil {
+		t.Fatal(err)
+	}
+	var synthetic *backendKeyData
+	for synthetic == nil {
+		var pkt rawPacket
+		if err := pkt.read(client, noMessageSizeLimit); err != nil {
+			t.Fatal(err)
+		}
+		if pkt.header == 'K' {
+			k, err := parseBackendKeyData(&pkt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			synthetic = k
+		}
+	}
+	if *synthetic == backend {
+		t.Fatal("backend backend key is exposed.")
+	}
+
+	// unknown key is ignored.
+	for _, key := range []backendKeyData{backend, *synthetic} {
+		req := (&cancelRequest{key.pid, key.secret}).toRaw()
+		if err := req.write(testServe(t, s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case key := <-cancelled:
+		if key != backend {
+			t.Fatalf("%v != %v", key, backend)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not cancelled.")
+	}
+	select {
+	case key := <-cancelled:
+		t.Fatalf("unexpected cancel %v", key)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	osuser "os/user"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// checkStep is a row of `check` output.
+type checkStep struct {
+	hop     string
+	step    string
+	elapsed time.Duration
+	detail  string
+	err     error
+}
+
+var authenticationNames = map[uint32]string{
+	authenticationOk:                "trust",
+	authenticationCleartextPassword: "password",
+	authenticationMD5Password:       "md5",
+	authenticationSASL:              "SASL",
+}
+
+// probePostgres sends StartupMessage and reads the first response. returns the requested authentication.
+func probePostgres(conn net.Conn, entry *Connection, fsys fs.FS, user string) (string, error) {
+	up, err := startUpstreamTLS(conn, entry, fsys)
+	if err != nil {
+		return "", err
+	}
+
+	params := map[string]string{}
+	if err := entry.Params.apply(params, user); err != nil {
+		return "", err
+	}
+	startup := &startupMessage{params}
+	startup.setDataabse(entry.Dbname)
+	startup.setUser(entry.upstreamUser(user))
+	raw := startup.toRaw()
+	if err := raw.write(up); err != nil {
+		return "", err
+	}
+
+	// no password is sent.
+	terminate := rawPacket{header: 'X'}
+	defer terminate.write(up)
+
+	auth, err := readAuthentication(up)
+	if err != nil {
+		return "", err
+	}
+	name, exists := authenticationNames[auth.code]
+	if !exists {
+		name = fmt.Sprintf("authentication %d", auth.code)
+	}
+	if auth.code == authenticationSASL {
+		mechanisms, err := auth.mechanisms()
+		if err != nil {
+			return "", err
+		}
+		name = fmt.Sprintf("%s %v", name, mechanisms)
+	}
+	return name, nil
+}
+
+// checkEntry dials entry step by step. stops at the first failure.
+// each step fails after timeout unless zero.
+func checkEntry(conf *config, entry *Connection, startup bool, user string, timeout time.Duration) []checkStep {
+	var steps []checkStep
+	record := func(hop string) sshDialTrace {
+		return func(step string, elapsed time.Duration, err error) {
+			steps = append(steps, checkStep{hop: hop, step: step, elapsed: elapsed, err: err})
+		}
+	}
+
+	sshConf := newSshTunnelSshConfig(conf.fs, &entry.Ssh)
+	for i := range sshConf.jump {
+		sshConf.jump[i].trace = record(fmt.Sprintf("%s@%s", sshConf.jump[i].user, sshConf.jump[i].addr))
+		sshConf.jump[i].timeout = timeout
+	}
+	hop := fmt.Sprintf("%s@%s", sshConf.user, sshConf.addr)
+	sshConf.trace = record(hop)
+	sshConf.timeout = timeout
+
+	client, err := dialSshClient(sshConf)
+	if err != nil {
+		if len(steps) == 0 || steps[len(steps)-1].err == nil {
+			// before dialing. e.g. unreadable known_hosts.
+			steps = append(steps, checkStep{hop: hop, step: "ssh", err: err})
+		}
+		return steps
+	}
+	defer client.Close()
+
+	start := time.Now()
+	stop := closeAfter(client, timeout)
+	conn, err := dialForward(client, entry.Addr)
+	if !stop() {
+		if err == nil {
+			conn.Close()
+		}
+		err = errTimedOut(timeout)
+	}
+	steps = append(steps, checkStep{hop: entry.Addr, step: "forward", elapsed: time.Since(start), err: err})
+	if err != nil || !startup {
+		return steps
+	}
+	defer conn.Close()
+
+	start = time.Now()
+	stop = closeAfter(conn, timeout)
+	detail, err := probePostgres(conn, entry, conf.fs, user)
+	if !stop() {
+		detail, err = "", errTimedOut(timeout)
+	}
+	return append(steps, checkStep{hop: entry.Addr, step: "postgres", elapsed: time.Since(start), detail: detail, err: err})
+}
+
+// runCheck prints steps of names or every entry. returns false if any fails.
+func runCheck(w io.Writer, conf *config, names []string, startup bool, user string, timeout time.Duration) bool {
+	if len(names) == 0 {
+		for name := range conf.Connections {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	ok := true
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENTRY\tHOP\tSTEP\tTIME\tRESULT")
+	for _, name := range names {
+		entry, exists := conf.Connections[name]
+		if !exists {
+			ok = false
+			fmt.Fprintf(tw, "%s\t-\tconfig\t-\tFAIL: no such entry\n", name)
+			continue
+		}
+
+		for _, step := range checkEntry(conf, entry, startup, user, timeout) {
+			result := "ok"
+			if step.detail != "" {
+				result = fmt.Sprintf("ok (%s)", step.detail)
+			}
+			if step.err != nil {
+				ok = false
+				result = fmt.Sprintf("FAIL: %s", step.err)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%.1fms\t%s\n", name, step.hop, step.step, float64(step.elapsed)/float64(time.Millisecond), result)
+		}
+	}
+	tw.Flush()
+	return ok
+}
+
+// checkCommand runs `check [-startup=false] [-user name] [-timeout 10s] [entry...]`. returns exit code.
+func checkCommand(conf *config, args []string) int {
+	user := ""
+	if u, err := osuser.Current(); err == nil {
+		user = u.Username
+	}
+
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	startupFlag := flags.Bool("startup", true, "send StartupMessage and wait for the authentication request.")
+	userFlag := flags.String("user", user, "user in StartupMessage. rewritten by user and user_map of the entry.")
+	timeoutFlag := flags.Duration("timeout", 10*time.Second, "fail each step after this long. 0 for none.")
+	flags.Parse(args)
+
+	if !runCheck(os.Stdout, conf, flags.Args(), *startupFlag, *userFlag, *timeoutFlag) {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCheckEntry(t *testing.T) {
+	pg := startTestPostgres(t, handleTestPostgresAuth(authenticationMD5Password, "secret"))
+	// accepts and never answers.
+	silentPg := startTestPostgres(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+	silentSsh, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { silentSsh.Close() })
+	go func() {
+		for {
+			conn, err := silentSsh.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	rejectAll := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, pubkey ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, fmt.Errorf("rejected")
+		},
+	}
+	skey, err := ssh.ParsePrivateKey([]byte(serverHostKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejectAll.AddHostKey(skey)
+
+	tests := []struct {
+		name       string
+		srv        *testSshServer
+		pg         string
+		knownhosts *string
+		startup    bool
+		steps      string
+		failed     string
+		detail     string
+	}{
+		{
+			name:    "ok",
+			srv:     startTestSshJumpServer(t),
+			startup: true,
+			steps:   "dns,tcp,handshake,host key,auth,forward,postgres",
+			detail:  "md5",
+		},
+		{
+			name:  "no_startup",
+			srv:   startTestSshJumpServer(t),
+			steps: "dns,tcp,handshake,host key,auth,forward",
+		},
+		{
+			name:       "unknown_host_key",
+			srv:        startTestSshJumpServer(t),
+			knownhosts: new(string),
+			steps:      "dns,tcp,handshake,host key",
+			failed:     "host key",
+		},
+		{
+			name:   "auth_failed",
+			srv:    serveTestSsh(t, true, rejectAll),
+			steps:  "dns,tcp,handshake,host key,auth",
+			failed: "auth",
+		},
+		{
+			name:   "ssh_timeout",
+			srv:    &testSshServer{l: silentSsh},
+			steps:  "dns,tcp,handshake",
+			failed: "timed out after 100ms",
+		},
+		{
+			name:    "postgres_timeout",
+			srv:     startTestSshJumpServer(t),
+			pg:      silentPg,
+			startup: true,
+			steps:   "dns,tcp,handshake,host key,auth,forward,postgres",
+			failed:  "timed out after 100ms",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr := pg
+			if test.pg != "" {
+				addr = test.pg
+			}
+			s := newTestServer(test.srv, map[string]*Connection{
+				"db": {
+					Addr:   addr,
+					Dbname: "db",
+				},
+			})
+			if test.knownhosts != nil {
+				s.config.fs = testDialSshTunnelFs{knownhosts: *test.knownhosts}
+			}
+
+			steps := checkEntry(s.config, s.config.Connections["db"], test.startup, "guest", 100*time.Millisecond)
+			var names []string
+			for _, step := range steps {
+				names = append(names, step.step)
+			}
+			if actual := strings.Join(names, ","); actual != test.steps {
+				t.Fatalf("%s != %s", actual, test.steps)
+			}
+
+			last := steps[len(steps)-1]
+			if test.failed == "" && last.err != nil {
+				t.Fatal(last.err)
+			}
+			if test.failed != "" && last.err == nil {
+				t.Fatal("no error occurred.")
+			}
+			if strings.HasPrefix(test.failed, "timed out") && last.err.Error() != test.failed {
+				t.Fatalf("%s != %s", last.err, test.failed)
+			}
+			if last.detail != test.detail {
+				t.Fatalf("%s != %s", last.detail, test.detail)
+			}
+		})
+	}
+}
+
+func TestRunCheck(t *testing.T) {
+	pg := startTestPostgres(t, handleTestPostgresReady)
+	s := newTestServer(startTestSshJumpServer(t), map[string]*Connection{
+		"db": {
+			Addr:   pg,
+			Dbname: "db",
+		},
+	})
+
+	out := &bytes.Buffer{}
+	if !runCheck(out, s.config, nil, true, "guest", time.Second) {
+		t.Fatal(out)
+	}
+	if !strings.Contains(out.String(), "ok (trust)") {
+		t.Fatal(out)
+	}
+
+	out.Reset()
+	if runCheck(out, s.config, []string{"db", "notexists"}, true, "guest", time.Second) {
+		t.Fatal(out)
+	}
+	if !strings.Contains(out.String(), "notexists  -") || !strings.Contains(out.String(), "FAIL: no such entry") {
+		t.Fatal(out)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"sort"
+	"strings"
+)
+
+var clientAuthMethods = map[string]bool{
+	"trust":         true,
+	"md5":           true,
+	"scram-sha-256": true,
+}
+
+// clientAuth authenticates clients before any ssh connection is made.
+type clientAuth struct {
+	method string
+	// role -> plain password, `md5...` or `SCRAM-SHA-256$...`.
+	users map[string]string
+}
+
+// parseUserList parses pgbouncer style userlist.txt. `"role" "secret"` per line.
+func parseUserList(b []byte) (map[string]string, error) {
+	users := map[string]string{}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		var fields []string
+		for len(line) > 0 {
+			if line[0] != '"' {
+				return nil, fmt.Errorf("line %d: expected '\"'", n)
+			}
+			v := strings.Builder{}
+			i := 1
+			for ; i < len(line); i++ {
+				if line[i] == '"' {
+					// "" is an escaped quote.
+					if i+1 < len(line) && line[i+1] == '"' {
+						v.WriteByte('"')
+						i++
+						continue
+					}
+					break
+				}
+				v.WriteByte(line[i])
+			}
+			if i >= len(line) {
+				return nil, fmt.Errorf("line %d: unterminated quote", n)
+			}
+			fields = append(fields, v.String())
+			line = strings.TrimSpace(line[i+1:])
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected \"role\" \"secret\"", n)
+		}
+		users[fields[0]] = fields[1]
+	}
+	return users, s.Err()
+}
+
+// loadClientAuth returns nil for empty method. every client is accepted then.
+func loadClientAuth(fsys fs.FS, method, usersFile string) (*clientAuth, error) {
+	if method == "" {
+		return nil, nil
+	}
+	if !clientAuthMethods[method] {
+		return nil, fmt.Errorf("invalid -auth: %s", method)
+	}
+	r := &clientAuth{
+		method: method,
+		users:  map[string]string{},
+	}
+	if method == "trust" {
+		return r, nil
+	}
+
+	if usersFile == "" {
+		return nil, fmt.Errorf("requires: -auth-file")
+	}
+	b, err := fs.ReadFile(fsys, usersFile)
+	if err != nil {
+		return nil, err
+	}
+	users, err := parseUserList(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", usersFile, err)
+	}
+	r.users = users
+	return r, nil
+}
+
+// validate rejects scram-sha-256 for entries whose upstream may ask SCRAM again.
+// libpq fails with "duplicate SASL authentication request".
+func (a *clientAuth) validate(conf *config) error {
+	if a == nil || a.method != "scram-sha-256" {
+		return nil
+	}
+	names := make([]string, 0, len(conf.Connections))
+	for name := range conf.Connections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !conf.Connections[name].injectsPassword() {
+			return fmt.Errorf("`%s`: -auth scram-sha-256 requires `password` or `password_command`", name)
+		}
+	}
+	return nil
+}
+
+func isLoopback(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.IsLoopback()
+	case *net.UnixAddr:
+		return true
+	}
+	return false
+}
+
+func authFailed(role string) error {
+	return &pgError{
+		severity: "FATAL",
+		code:     "28P01",
+		err:      fmt.Errorf("password authentication failed for user %q", role),
+	}
+}
+
+func readPasswordMessage(r io.Reader) (*rawPacket, error) {
+	var pkt rawPacket
+	if err := pkt.read(r, maxAuthMessageSize); err != nil {
+		return nil, err
+	}
+	if pkt.header != 'p' {
+		return nil, fmt.Errorf("expected password response, got %q", pkt.header)
+	}
+	return &pkt, nil
+}
+
+func writeAuthentication(w io.Writer, code uint32, data []byte) error {
+	raw := (&authentication{code, data}).toRaw()
+	return raw.write(w)
+}
+
+// authenticate runs the exchange for role on conn.
+// AuthenticationOk is not sent. it is up to the upstream or password injection.
+func (a *clientAuth) authenticate(conn net.Conn, role string) error {
+	if a.method == "trust" {
+		if !isLoopback(conn.RemoteAddr()) {
+			return &pgError{
+				severity: "FATAL",
+				code:     "28000",
+				err:      fmt.Errorf("trust authentication is only allowed for loopback connections"),
+			}
+		}
+		return nil
+	}
+
+	secret, exists := a.users[role]
+	if !exists {
+		// run the exchange anyway. do not reveal which roles exist.
+		secret = "SCRAM-SHA-256$4096:AAAAAAAAAAAAAAAAAAAAAA==$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+	}
+
+	switch a.method {
+	case "md5":
+		if exists && strings.HasPrefix(secret, "SCRAM-SHA-256$") {
+			// md5 can not be verified with SCRAM secret.
+			return authFailed(role)
+		}
+		salt := make([]byte, 4)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		if err := writeAuthentication(conn, authenticationMD5Password, salt); err != nil {
+			return err
+		}
+		pkt, err := readPasswordMessage(conn)
+		if err != nil {
+			return err
+		}
+		response, err := readString(bytes.NewBuffer(pkt.data))
+		if err != nil {
+			return err
+		}
+
+		var wants string
+		if strings.HasPrefix(secret, "md5") && len(secret) == 35 {
+			sum := md5.Sum(append([]byte(secret[3:]), salt...))
+			wants = "md5" + hex.EncodeToString(sum[:])
+		} else {
+			wants = md5Password(role, secret, salt)
+		}
+		if !exists || subtle.ConstantTimeCompare([]byte(response), []byte(wants)) != 1 {
+			return authFailed(role)
+		}
+		return nil
+
+	case "scram-sha-256":
+		var verifier *scramSecret
+		if strings.HasPrefix(secret, "SCRAM-SHA-256$") {
+			v, err := parseScramSecret(secret)
+			if err != nil {
+				return fmt.Errorf("role %q: %w", role, err)
+			}
+			verifier = v
+		} else if strings.HasPrefix(secret, "md5") && len(secret) == 35 {
+			return authFailed(role)
+		} else {
+			salt := make([]byte, 16)
+			if _, err := rand.Read(salt); err != nil {
+				return err
+			}
+			verifier = newScramSecret(secret, salt, 4096)
+		}
+		server := newScramServer(verifier)
+
+		if err := writeAuthentication(conn, authenticationSASL, []byte("SCRAM-SHA-256\x00\x00")); err != nil {
+			return err
+		}
+		pkt, err := readPasswordMessage(conn)
+		if err != nil {
+			return err
+		}
+		b := bytes.NewBuffer(pkt.data)
+		mechanism, err := readString(b)
+		if err != nil {
+			return err
+		}
+		if mechanism != "SCRAM-SHA-256" {
+			return fmt.Errorf("unsupported SASL mechanism: %s", mechanism)
+		}
+		if _, err := read32(b); err != nil {
+			return err
+		}
+		serverFirst, err := server.first(b.String())
+		if err != nil {
+			return err
+		}
+		if err := writeAuthentication(conn, authenticationSASLContinue, []byte(serverFirst)); err != nil {
+			return err
+		}
+
+		pkt, err = readPasswordMessage(conn)
+		if err != nil {
+			return err
+		}
+		serverFinal, err := server.final(string(pkt.data))
+		if err != nil || !exists {
+			return authFailed(role)
+		}
+		return writeAuthentication(conn, authenticationSASLFinal, []byte(serverFinal))
+	}
+	return fmt.Errorf("invalid auth method: %s", a.method)
+}
+
+// allows reports whether role is granted to entry. every role if no roles are listed.
+func (c *Connection) allows(role string) bool {
+	if len(c.Roles) == 0 {
+		return true
+	}
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseUserList(t *testing.T) {
+	b := []byte(`
+# comment
+"alice" "secret"
+"bob"   "md5aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+"quo""te" "pass word"
+`)
+	actual, err := parseUserList(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wants := map[string]string{
+		"alice":   "secret",
+		"bob":     "md5aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+		"quo\"te": "pass word",
+	}
+	if !reflect.DeepEqual(actual, wants) {
+		t.Fatalf("%v != %v", actual, wants)
+	}
+
+	for _, invalid := range []string{
+		`alice secret`,
+		`"alice" "secret`,
+		`"alice"`,
+		`"alice" "secret" "extra"`,
+	} {
+		if _, err := parseUserList([]byte(invalid)); err == nil {
+			t.Fatalf("no error occurred: %s", invalid)
+		}
+	}
+}
+
+// testClientAuth answers the proxy's challenge with password and returns received message types.
+func testClientAuth(t *testing.T, s *server, user, password string) (string, *errorResponse) {
+	client := testServe(t, s)
+	startup := (&startupMessage{map[string]string{"database": "db", "user": user}}).toRaw()
+	if err := startup.write(client); err != nil {
+		t.Fatal(err)
+	}
+
+	var scram *scramClient
+	messages := ""
+	for !strings.HasSuffix(messages, "Z") && !strings.HasSuffix(messages, "E") {
+		var pkt rawPacket
+		if err := pkt.read(client, noMessageSizeLimit); err != nil {
+			t.Fatal(err)
+		}
+		messages += string(pkt.header)
+		if pkt.header == 'E' {
+			e, err := parseErrorResponse(&pkt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return messages, e
+		}
+		if pkt.header != 'R' {
+			continue
+		}
+
+		auth, err := parseAuthentication(&pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reply rawPacket
+		switch auth.code {
+		case authenticationMD5Password:
+			reply = newPasswordMessage(md5Password(user, password, auth.data)).toRaw()
+		case authenticationSASL:
+			scram = newScramClient(user, password)
+			reply = newSASLInitialResponse("SCRAM-SHA-256", []byte(scram.first())).toRaw()
+		case authenticationSASLContinue:
+			final, err := scram.final(string(auth.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply = rawPacket{'p', []byte(final)}
+		case authenticationSASLFinal:
+			if err := scram.verify(string(auth.data)); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		default:
+			continue
+		}
+		if err := reply.write(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return messages, nil
+}
+
+func TestServeClientAuth(t *testing.T) {
+	md5Secret := md5.Sum([]byte("secretalice"))
+
+	tests := []struct {
+		name     string
+		method   string
+		users    map[string]string
+		roles    []string
+		user     string
+		password string
+		messages string
+		code     string
+	}{
+		{
+			name:     "trust_not_loopback",
+			method:   "trust",
+			user:     "alice",
+			messages: "E",
+			code:     "28000",
+		},
+		{
+			name:     "md5",
+			method:   "md5",
+			users:    map[string]string{"alice": "secret"},
+			user:     "alice",
+			password: "secret",
+			messages: "RRZ",
+		},
+		{
+			name:     "md5_hashed",
+			method:   "md5",
+			users:    map[string]string{"alice": "md5" + hex.EncodeToString(md5Secret[:])},
+			user:     "alice",
+			password: "secret",
+			messages: "RRZ",
+		},
+		{
+			name:     "md5_wrong_password",
+			method:   "md5",
+			users:    map[string]string{"alice": "secret"},
+			user:     "alice",
+			password: "wrong",
+			messages: "RE",
+			code:     "28P01",
+		},
+		{
+			name:     "md5_unknown_user",
+			method:   "md5",
+			users:    map[string]string{"alice": "secret"},
+			user:     "bob",
+			password: "secret",
+			messages: "RE",
+			code:     "28P01",
+		},
+		{
+			name:     "scram",
+			method:   "scram-sha-256",
+			users:    map[string]string{"alice": "secret"},
+			user:     "alice",
+			password: "secret",
+			messages: "RRRRZ",
+		},
+		{
+			name:     "scram_wrong_password",
+			method:   "scram-sha-256",
+			users:    map[string]string{"alice": "secret"},
+			user:     "alice",
+			password: "wrong",
+			messages: "RRE",
+			code:     "28P01",
+		},
+		{
+			name:     "role_allowed",
+			method:   "md5",
+			users:    map[string]string{"alice": "secret"},
+			roles:    []string{"alice"},
+			user:     "alice",
+			password: "secret",
+			messages: "RRZ",
+		},
+		{
+			name:     "role_not_allowed",
+			method:   "md5",
+			users:    map[string]string{"alice": "secret"},
+			roles:    []string{"bob"},
+			user:     "alice",
+			password: "secret",
+			messages: "RE",
+			code:     "28000",
+		},
+	}
+
+	pg := startTestPostgres(t, handleTestPostgresReady)
+	srv := startTestSshJumpServer(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(srv, map[string]*Connection{
+				"db": {
+					Addr:   pg,
+					Dbname: "db",
+					Roles:  test.roles,
+				},
+			})
+			s.auth = &clientAuth{
+				method: test.method,
+				users:  test.users,
+			}
+
+			messages, e := testClientAuth(t, s, test.user, test.password)
+			if messages != test.messages {
+				t.Fatalf("%s != %s", messages, test.messages)
+			}
+			if test.code != "" && (e == nil || e.get('C') != test.code) {
+				t.Fatalf("%v != %s", e, test.code)
+			}
+		})
+	}
+}
+
+func TestLoadClientAuth(t *testing.T) {
+	fsys := testDialSshTunnelFs{
+		files: map[string]string{
+			"/userlist.txt": `"alice" "secret"`,
+		},
+	}
+
+	auth, err := loadClientAuth(fsys, "scram-sha-256", "/userlist.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(auth.users, map[string]string{"alice": "secret"}) {
+		t.Fatal(auth.users)
+	}
+
+	if auth, err := loadClientAuth(fsys, "", ""); err != nil || auth != nil {
+		t.Fatalf("%v, %v", auth, err)
+	}
+
+	for _, test := range []struct {
+		method string
+		file   string
+		err    string
+	}{
+		{"password", "", "invalid -auth: password"},
+		{"md5", "", "requires: -auth-file"},
+	} {
+		if _, err := loadClientAuth(fsys, test.method, test.file); err == nil || err.Error() != test.err {
+			t.Fatalf("%v != %s", err, test.err)
+		}
+	}
+}
+
+func TestClientAuthValidate(t *testing.T) {
+	conf := &config{
+		Connections: map[string]*Connection{
+			"injected": {Password: "secret"},
+			"command":  {PasswordCommand: "echo secret"},
+		},
+	}
+	for _, method := range []string{"trust", "md5", "scram-sha-256"} {
+		if err := (&clientAuth{method: method}).validate(conf); err != nil {
+			t.Fatalf("%s: %s", method, err)
+		}
+	}
+
+	conf.Connections["passthrough"] = &Connection{}
+	if err := (&clientAuth{method: "md5"}).validate(conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*clientAuth)(nil).validate(conf); err != nil {
+		t.Fatal(err)
+	}
+	wants := "`passthrough`: -auth scram-sha-256 requires `password` or `password_command`"
+	if err := (&clientAuth{method: "scram-sha-256"}).validate(conf); err == nil || err.Error() != wants {
+		t.Fatalf("%v != %s", err, wants)
+	}
+}
+
+func TestReadPasswordMessageTooLarge(t *testing.T) {
+	// never allocated.
+	_, err := readPasswordMessage(strings.NewReader("p\x7f\xff\xff\xff"))
+	if err == nil || err.Error() != "message 'p' too large: 2147483647" {
+		t.Fatal(err)
+	}
+}
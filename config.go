@@ -3,23 +3,84 @@ package main
 import (
 	"fmt"
 	"io/fs"
+	"net"
+	"os"
 	"os/user"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 )
 
 type sshConnection struct {
+	Host       string   `toml:"host"`
+	Config     string   `toml:"config"`
 	Addr       string   `toml:"addr"`
 	User       string   `toml:"user"`
 	Identity   []string `toml:"identity"`
 	KnownHosts string   `toml:"known_hosts"`
+	Agent      string   `toml:"agent"`
+
+	StrictHostKeyChecking string `toml:"strict_host_key_checking"`
+
+	PassphraseEnv     string `toml:"passphrase_env"`
+	PassphraseCommand string `toml:"passphrase_command"`
+
+	Auth                []string `toml:"auth"`
+	PasswordCommand     string   `toml:"password_command"`
+	KeyboardInteractive string   `toml:"keyboard_interactive"`
+
+	ServerAliveInterval int `toml:"server_alive_interval"`
+	ServerAliveCountMax int `toml:"server_alive_count_max"`
+
+	Jump []sshConnection `toml:"jump"`
 }
 
 type Connection struct {
 	Addr   string        `toml:"addr"`
+	Socket string        `toml:"socket"`
 	Dbname string        `toml:"dbname"`
 	Ssh    sshConnection `toml:"ssh"`
+
+	Sslmode     string `toml:"sslmode"`
+	Sslrootcert string `toml:"sslrootcert"`
+	Sslcert     string `toml:"sslcert"`
+	Sslkey      string `toml:"sslkey"`
+
+	Password        string `toml:"password"`
+	PasswordCommand string `toml:"password_command"`
+
+	// upstream role. client's `user` is passed through if empty.
+	User string `toml:"user"`
+	// client's `user` -> upstream role. precedes User.
+	UserMap map[string]string `toml:"user_map"`
+
+	// roles authenticated by the proxy which may use this entry. any if empty.
+	Roles []string `toml:"roles"`
+
+	Params startupParams `toml:"params"`
+
+	// rejects statements which may write.
+	Readonly bool `toml:"readonly"`
+
+	// statements are appended as JSON lines if set.
+	AuditLog string `toml:"audit_log"`
+
+	// dedicated listen address. every client on it uses this entry.
+	Listen string `toml:"listen"`
+}
+
+// upstreamUser returns the role sent to postgres for client's user.
+func (c *Connection) upstreamUser(user string) string {
+	if role, exists := c.UserMap[user]; exists {
+		return role
+	}
+	if c.User != "" {
+		return c.User
+	}
+	return user
 }
 
 type config struct {
@@ -27,6 +88,18 @@ type config struct {
 	Connections map[string]*Connection
 }
 
+// dedicated returns names of entries with `listen` in order.
+func (c *config) dedicated() []string {
+	var r []string
+	for name, conf := range c.Connections {
+		if conf.Listen != "" {
+			r = append(r, name)
+		}
+	}
+	sort.Strings(r)
+	return r
+}
+
 var hasPort = regexp.MustCompile(`:\d+$`)
 
 func clarifyKnownPort(addr string, kp int16) string {
@@ -36,6 +109,171 @@ func clarifyKnownPort(addr string, kp int16) string {
 	return fmt.Sprintf("%s:%d", addr, kp)
 }
 
+// applySshConfig fills unset fields from ssh_config(5) entry for Host.
+// ProxyJump is ignored for a jump host. nested jump is not supported.
+func (c *sshConnection) applySshConfig(fsys fs.FS, isJump bool) error {
+	if c.Config == "" {
+		c.Config = "~/.ssh/config"
+	}
+	h, err := lookupSshConfig(fsys, c.Config, c.Host)
+	if err != nil {
+		return err
+	}
+
+	if c.Addr == "" {
+		c.Addr = net.JoinHostPort(h.hostname(), h.port())
+	}
+	if c.User == "" {
+		c.User = h.get("user")
+	}
+	if c.Identity == nil {
+		for _, ident := range h.getAll("identityfile") {
+			c.Identity = append(c.Identity, h.expand(ident))
+		}
+	}
+	if c.KnownHosts == "" {
+		if v := h.get("userknownhostsfile"); v != "" {
+			c.KnownHosts = h.expand(v)
+		}
+	}
+	if c.StrictHostKeyChecking == "" {
+		c.StrictHostKeyChecking = strings.ToLower(h.get("stricthostkeychecking"))
+	}
+	if c.Auth == nil {
+		// unsupported methods (gssapi-with-mic, hostbased) are dropped.
+		for _, method := range strings.Split(h.get("preferredauthentications"), ",") {
+			if sshAuthMethods[method] {
+				c.Auth = append(c.Auth, method)
+			}
+		}
+	}
+	if c.ServerAliveInterval == 0 {
+		if v := h.get("serveraliveinterval"); v != "" {
+			if c.ServerAliveInterval, err = strconv.Atoi(v); err != nil {
+				return fmt.Errorf("ServerAliveInterval: %w", err)
+			}
+		}
+	}
+	if c.ServerAliveCountMax == 0 {
+		if v := h.get("serveralivecountmax"); v != "" {
+			if c.ServerAliveCountMax, err = strconv.Atoi(v); err != nil {
+				return fmt.Errorf("ServerAliveCountMax: %w", err)
+			}
+		}
+	}
+	if c.Agent == "" {
+		switch v := h.get("identityagent"); v {
+		case "", "SSH_AUTH_SOCK":
+		case "none":
+			c.Agent = v
+		default:
+			c.Agent = h.expand(v)
+		}
+	}
+
+	if c.Jump == nil && !isJump {
+		if v := h.get("proxyjump"); v != "" && v != "none" {
+			for _, spec := range strings.Split(v, ",") {
+				jump := sshConnection{
+					Host:   spec,
+					Config: c.Config,
+				}
+				var port string
+				if i := strings.LastIndex(spec, "@"); i >= 0 {
+					jump.User = spec[:i]
+					jump.Host = spec[i+1:]
+				}
+				if host, p, err := net.SplitHostPort(jump.Host); err == nil {
+					jump.Host = host
+					port = p
+				}
+
+				if err := jump.applySshConfig(fsys, true); err != nil {
+					return err
+				}
+				if port != "" {
+					host, _, _ := net.SplitHostPort(jump.Addr)
+					jump.Addr = net.JoinHostPort(host, port)
+				}
+				c.Jump = append(c.Jump, jump)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *sshConnection) clarify(fsys fs.FS, path string, isJump bool) error {
+	if c.Host != "" {
+		if err := c.applySshConfig(fsys, isJump); err != nil {
+			return fmt.Errorf("`%s.host`: %w", path, err)
+		}
+	}
+
+	if c.Addr == "" {
+		return fmt.Errorf("requires: `%s.addr`", path)
+	}
+	c.Addr = clarifyKnownPort(c.Addr, 22)
+	if c.User == "" {
+		if u, _ := user.Current(); u != nil {
+			c.User = u.Username
+		}
+	}
+	if c.Identity == nil {
+		c.Identity = []string{
+			"~/.ssh/id_rsa",
+			"~/.ssh/id_ed25519",
+		}
+	}
+	if c.KnownHosts == "" {
+		c.KnownHosts = "~/.ssh/known_hosts"
+	}
+	if c.StrictHostKeyChecking == "" {
+		c.StrictHostKeyChecking = "yes"
+	}
+	mode, exists := strictHostKeyCheckingModes[c.StrictHostKeyChecking]
+	if !exists {
+		return fmt.Errorf("invalid `%s.strict_host_key_checking`: %s", path, c.StrictHostKeyChecking)
+	}
+	c.StrictHostKeyChecking = mode
+	if c.Auth == nil {
+		// password and keyboard-interactive are opt-in.
+		c.Auth = []string{
+			"publickey",
+		}
+	}
+	for _, method := range c.Auth {
+		if !sshAuthMethods[method] {
+			return fmt.Errorf("invalid `%s.auth`: %s", path, method)
+		}
+	}
+	if c.ServerAliveInterval < 0 {
+		return fmt.Errorf("invalid `%s.server_alive_interval`: %d", path, c.ServerAliveInterval)
+	}
+	if c.ServerAliveCountMax < 0 {
+		return fmt.Errorf("invalid `%s.server_alive_count_max`: %d", path, c.ServerAliveCountMax)
+	}
+	if c.ServerAliveCountMax == 0 {
+		c.ServerAliveCountMax = 3
+	}
+	switch c.Agent {
+	case "":
+		c.Agent = os.Getenv("SSH_AUTH_SOCK")
+	case "none":
+		c.Agent = ""
+	}
+
+	for i := range c.Jump {
+		jump := &c.Jump[i]
+		if len(jump.Jump) > 0 {
+			return fmt.Errorf("nested jump is not supported: `%s.jump[%d].jump`", path, i)
+		}
+		if err := jump.clarify(fsys, fmt.Sprintf("%s.jump[%d]", path, i), true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func parseConfig(fs fs.FS, path string) (*config, error) {
 	r := config{
 		fs:          fs,
@@ -46,32 +284,50 @@ func parseConfig(fs fs.FS, path string) (*config, error) {
 		return nil, err
 	}
 
+	listens := map[string]bool{}
 	for name, conf := range r.Connections {
+		if conf.Listen != "" {
+			if listens[conf.Listen] {
+				return nil, fmt.Errorf("duplicated `listen`: %s", conf.Listen)
+			}
+			listens[conf.Listen] = true
+		}
+
+		if conf.Socket != "" {
+			if conf.Addr != "" {
+				return nil, fmt.Errorf("`addr` and `socket` are exclusive")
+			}
+			conf.Addr = "unix:" + conf.Socket
+			conf.Socket = ""
+		}
 		if conf.Addr == "" {
 			return nil, fmt.Errorf("requires: `addr`")
 		}
-		conf.Addr = clarifyKnownPort(conf.Addr, 5432)
+		if !strings.HasPrefix(conf.Addr, "unix:") {
+			conf.Addr = clarifyKnownPort(conf.Addr, 5432)
+		}
 		if conf.Dbname == "" {
 			conf.Dbname = name
 		}
-
-		if conf.Ssh.Addr == "" {
-			return nil, fmt.Errorf("requires: `ssh.addr`")
+		if conf.Sslmode == "" {
+			conf.Sslmode = "disable"
 		}
-		conf.Ssh.Addr = clarifyKnownPort(conf.Ssh.Addr, 22)
-		if conf.Ssh.User == "" {
-			if u, _ := user.Current(); u != nil {
-				conf.Ssh.User = u.Username
-			}
+		if !upstreamSslmodes[conf.Sslmode] {
+			return nil, fmt.Errorf("invalid `sslmode`: %s", conf.Sslmode)
 		}
-		if conf.Ssh.Identity == nil {
-			conf.Ssh.Identity = []string{
-				"~/.ssh/id_rsa",
-				"~/.ssh/id_ed25519",
-			}
+		if (conf.Sslcert == "") != (conf.Sslkey == "") {
+			return nil, fmt.Errorf("requires both: `sslcert` and `sslkey`")
+		}
+		if conf.Password != "" && conf.PasswordCommand != "" {
+			return nil, fmt.Errorf("`password` and `password_command` are exclusive")
 		}
-		if conf.Ssh.KnownHosts == "" {
-			conf.Ssh.KnownHosts = "~/.ssh/known_hosts"
+
+		if err := conf.Params.clarify(); err != nil {
+			return nil, err
+		}
+
+		if err := conf.Ssh.clarify(fs, "ssh", false); err != nil {
+			return nil, err
 		}
 	}
 
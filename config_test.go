@@ -18,6 +18,7 @@ func TestParseConfig(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	t.Setenv("SSH_AUTH_SOCK", "/tmp/agent.sock")
 
 	tests := []struct {
 		name  string
@@ -35,8 +36,9 @@ func TestParseConfig(t *testing.T) {
 			path: "config_test/simple.toml",
 			wants: map[string]*Connection{
 				"simple": {
-					Addr:   "10.20.30.40:5432",
-					Dbname: "simple",
+					Addr:    "10.20.30.40:5432",
+					Dbname:  "simple",
+					Sslmode: "disable",
 					Ssh: sshConnection{
 						Addr: "10.20.30.40:22",
 						User: u.Username,
@@ -45,6 +47,327 @@ func TestParseConfig(t *testing.T) {
 							"~/.ssh/id_ed25519",
 						},
 						KnownHosts: "~/.ssh/known_hosts",
+						Agent:      "/tmp/agent.sock",
+
+						StrictHostKeyChecking: "yes",
+
+						Auth: []string{
+							"publickey",
+						},
+
+						ServerAliveCountMax: 3,
+					},
+				},
+			},
+		},
+		{
+			name: "socket",
+			path: "config_test/socket.toml",
+			wants: map[string]*Connection{
+				"simple": {
+					Addr:    "unix:/var/run/postgresql/.s.PGSQL.5432",
+					Dbname:  "simple",
+					Sslmode: "disable",
+					Ssh: sshConnection{
+						Addr: "10.20.30.40:22",
+						User: u.Username,
+						Identity: []string{
+							"~/.ssh/id_rsa",
+							"~/.ssh/id_ed25519",
+						},
+						KnownHosts: "~/.ssh/known_hosts",
+						Agent:      "/tmp/agent.sock",
+
+						StrictHostKeyChecking: "yes",
+
+						Auth: []string{
+							"publickey",
+						},
+
+						ServerAliveCountMax: 3,
+					},
+				},
+				"unix": {
+					Addr:    "unix:/tmp/.s.PGSQL.5433",
+					Dbname:  "unix",
+					Sslmode: "disable",
+					Ssh: sshConnection{
+						Addr: "10.20.30.40:22",
+						User: u.Username,
+						Identity: []string{
+							"~/.ssh/id_rsa",
+							"~/.ssh/id_ed25519",
+						},
+						KnownHosts: "~/.ssh/known_hosts",
+						Agent:      "/tmp/agent.sock",
+
+						StrictHostKeyChecking: "yes",
+
+						Auth: []string{
+							"publickey",
+						},
+
+						ServerAliveCountMax: 3,
+					},
+				},
+			},
+		},
+		{
+			name: "user",
+			path: "config_test/user.toml",
+			wants: map[string]*Connection{
+				"simple": {
+					Addr:    "10.20.30.40:5432",
+					Dbname:  "simple",
+					Sslmode: "disable",
+					User:    "app",
+					UserMap: map[string]string{
+						"alice": "app_ro",
+						"bob":   "app_rw",
+					},
+					Ssh: sshConnection{
+						Addr: "10.20.30.40:22",
+						User: u.Username,
+						Identity: []string{
+							"~/.ssh/id_rsa",
+							"~/.ssh/id_ed25519",
+						},
+						KnownHosts: "~/.ssh/known_hosts",
+						Agent:      "/tmp/agent.sock",
+
+						StrictHostKeyChecking: "yes",
+
+						Auth: []string{
+							"publickey",
+						},
+
+						ServerAliveCountMax: 3,
+					},
+				},
+			},
+		},
+		{
+			name: "params",
+			path: "config_test/params.toml",
+			wants: map[string]*Connection{
+				"simple": {
+					Addr:     "10.20.30.40:5432",
+					Dbname:   "simple",
+					Sslmode:  "disable",
+					Readonly: true,
+					AuditLog: "/var/log/pg-ssh-proxy/simple.jsonl",
+					Params: startupParams{
+						Set: map[string]string{
+							"application_name": "%u",
+						},
+						Default: map[string]string{
+							"statement_timeout": "30s",
+						},
+						Forbid: []string{
+							"replication",
+						},
+					},
+					Ssh: sshConnection{
+						Addr: "10.20.30.40:22",
+						User: u.Username,
+						Identity: []string{
+							"~/.ssh/id_rsa",
+							"~/.ssh/id_ed25519",
+						},
+						KnownHosts: "~/.ssh/known_hosts",
+						Agent:      "/tmp/agent.sock",
+
+						StrictHostKeyChecking: "yes",
+
+						Auth: []string{
+							"publickey",
+						},
+
+						ServerAliveCountMax: 3,
+					},
+				},
+			},
+		},
+		{
+			name: "listen",
+			path: "config_test/listen.toml",
+			wants: map[string]*Connection{
+				"simple": {
+					Addr:    "10.20.30.40:5432",
+					Dbname:  "simple",
+					Sslmode: "disable",
+					Listen:  "[::1]:15432",
+					Ssh: sshConnection{
+						Addr: "10.20.30.40:22",
+						User: u.Username,
+						Identity: []string{
+							"~/.ssh/id_rsa",
+							"~/.ssh/id_ed25519",
+						},
+						KnownHosts: "~/.ssh/known_hosts",
+						Agent:      "/tmp/agent.sock",
+
+						StrictHostKeyChecking: "yes",
+
+						Auth: []string{
+							"publickey",
+						},
+
+						ServerAliveCountMax: 3,
+					},
+				},
+			},
+		},
+		{
+			name: "agent_none",
+			path: "config_test/agent_none.toml",
+			wants: map[string]*Connection{
+				"simple": {
+					Addr:    "10.20.30.40:5432",
+					Dbname:  "simple",
+					Sslmode: "disable",
+					Ssh: sshConnection{
+						Addr: "10.20.30.40:22",
+						User: u.Username,
+						Identity: []string{
+							"~/.ssh/id_rsa",
+							"~/.ssh/id_ed25519",
+						},
+						KnownHosts: "~/.ssh/known_hosts",
+
+						StrictHostKeyChecking: "yes",
+
+						Auth: []string{
+							"publickey",
+						},
+
+						ServerAliveCountMax: 3,
+					},
+				},
+			},
+		},
+		{
+			name: "jump",
+			path: "config_test/jump.toml",
+			wants: map[string]*Connection{
+				"simple": {
+					Addr:    "10.20.30.40:5432",
+					Dbname:  "simple",
+					Sslmode: "disable",
+					Ssh: sshConnection{
+						Addr: "10.20.30.40:22",
+						User: u.Username,
+						Identity: []string{
+							"~/.ssh/id_rsa",
+							"~/.ssh/id_ed25519",
+						},
+						KnownHosts: "~/.ssh/known_hosts",
+						Agent:      "/tmp/agent.sock",
+
+						StrictHostKeyChecking: "yes",
+
+						Auth: []string{
+							"publickey",
+						},
+
+						ServerAliveCountMax: 3,
+
+						Jump: []sshConnection{
+							{
+								Addr: "bastion1.example.com:2222",
+								User: "jump",
+								Identity: []string{
+									"~/.ssh/id_jump",
+								},
+								KnownHosts: "~/.ssh/known_hosts",
+								Agent:      "/tmp/agent.sock",
+
+								StrictHostKeyChecking: "yes",
+
+								Auth: []string{
+									"publickey",
+								},
+
+								ServerAliveCountMax: 3,
+							},
+							{
+								Addr: "bastion2.example.com:22",
+								User: u.Username,
+								Identity: []string{
+									"~/.ssh/id_rsa",
+									"~/.ssh/id_ed25519",
+								},
+								KnownHosts: "~/.ssh/known_hosts",
+								Agent:      "/tmp/agent.sock",
+
+								StrictHostKeyChecking: "yes",
+
+								Auth: []string{
+									"publickey",
+								},
+
+								ServerAliveCountMax: 3,
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "jump_no_addr",
+			path: "config_test/jump_no_addr.toml",
+			err:  "requires: `ssh.jump[1].addr`",
+		},
+		{
+			name: "ssh_host",
+			path: "config_test/ssh_host.toml",
+			wants: map[string]*Connection{
+				"simple": {
+					Addr:    "10.20.30.40:5432",
+					Dbname:  "simple",
+					Sslmode: "disable",
+					Ssh: sshConnection{
+						Host:   "prod-db",
+						Config: "config_test/ssh_config",
+						Addr:   "db.internal:22",
+						User:   "explicit",
+						Identity: []string{
+							"~/.ssh/id_db",
+						},
+						KnownHosts: "~/.ssh/known_hosts.prod",
+						Agent:      "/tmp/agent.sock",
+
+						StrictHostKeyChecking: "yes",
+
+						Auth: []string{
+							"keyboard-interactive",
+							"publickey",
+						},
+
+						ServerAliveInterval: 30,
+						ServerAliveCountMax: 3,
+
+						Jump: []sshConnection{
+							{
+								Host:   "prod-bastion",
+								Config: "config_test/ssh_config",
+								Addr:   "bastion.example.com:2022",
+								User:   "jump",
+								Identity: []string{
+									"~/.ssh/id_bastion",
+								},
+								KnownHosts: "~/.ssh/known_hosts",
+								Agent:      "/tmp/agent.sock",
+
+								StrictHostKeyChecking: "yes",
+
+								Auth: []string{
+									"publickey",
+								},
+
+								ServerAliveCountMax: 3,
+							},
+						},
 					},
 				},
 			},
@@ -64,11 +387,46 @@ func TestParseConfig(t *testing.T) {
 			path: "config_test/no_addr.toml",
 			err:  "requires: `addr`",
 		},
+		{
+			name: "socket_and_addr",
+			path: "config_test/socket_and_addr.toml",
+			err:  "`addr` and `socket` are exclusive",
+		},
+		{
+			name: "sslmode_invalid",
+			path: "config_test/sslmode_invalid.toml",
+			err:  "invalid `sslmode`: allow",
+		},
+		{
+			name: "password_exclusive",
+			path: "config_test/password_exclusive.toml",
+			err:  "`password` and `password_command` are exclusive",
+		},
+		{
+			name: "params_invalid",
+			path: "config_test/params_invalid.toml",
+			err:  "invalid `params.set`: user",
+		},
+		{
+			name: "listen_duplicated",
+			path: "config_test/listen_duplicated.toml",
+			err:  "duplicated `listen`: [::1]:15432",
+		},
 		{
 			name: "no_ssh_addr",
 			path: "config_test/no_ssh_addr.toml",
 			err:  "requires: `ssh.addr`",
 		},
+		{
+			name: "strict_host_key_checking_invalid",
+			path: "config_test/strict_host_key_checking_invalid.toml",
+			err:  "invalid `ssh.strict_host_key_checking`: maybe",
+		},
+		{
+			name: "auth_invalid",
+			path: "config_test/auth_invalid.toml",
+			err:  "invalid `ssh.auth`: hostbased",
+		},
 	}
 
 	for _, test := range tests {
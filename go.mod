@@ -8,6 +8,6 @@ require (
 	github.com/mitchellh/go-homedir v1.1.0
 	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+	golang.org/x/sys v0.10.0
+	golang.org/x/term v0.10.0
 )
-
-require golang.org/x/sys v0.0.0-20211025201205-69cdffdb9359 // indirect
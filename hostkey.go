@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// appendFS is a file system which can append to a file. used to record new host keys.
+type appendFS interface {
+	fs.FS
+	AppendFile(name string, b []byte) error
+}
+
+var strictHostKeyCheckingModes = map[string]string{
+	"yes":        "yes",
+	"ask":        "yes",
+	"accept-new": "accept-new",
+	"no":         "no",
+	"off":        "no",
+}
+
+type hostKeyUnknownError struct {
+	host        string
+	fingerprint string
+}
+
+func (e *hostKeyUnknownError) Error() string {
+	return fmt.Sprintf("host key for %s is unknown (%s). add it to known_hosts or set `strict_host_key_checking = \"accept-new\"`", e.host, e.fingerprint)
+}
+
+type hostKeyMismatchError struct {
+	host      string
+	presented string
+	expected  []string
+}
+
+func (e *hostKeyMismatchError) Error() string {
+	return fmt.Sprintf("HOST KEY FOR %s HAS CHANGED: presented %s, expected %s", e.host, e.presented, strings.Join(e.expected, " or "))
+}
+
+var knownHostsMutex sync.Mutex
+
+func appendKnownHost(fsys fs.FS, name, host string, key ssh.PublicKey) error {
+	afs, ok := fsys.(appendFS)
+	if !ok {
+		return fmt.Errorf("%s: read-only", name)
+	}
+
+	knownHostsMutex.Lock()
+	defer knownHostsMutex.Unlock()
+	return afs.AppendFile(name, []byte(knownhosts.Line([]string{host}, key)+"\n"))
+}
+
+func (c *sshTunnelSshConfig) acceptNewHostKey() bool {
+	return c.strictHostKeyChecking == "accept-new" || c.strictHostKeyChecking == "no"
+}
+
+// verifyHostKey applies strict_host_key_checking to the result of known_hosts lookup.
+func verifyHostKey(config sshTunnelSshConfig, known ssh.HostKeyCallback) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := known(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+
+		fingerprint := ssh.FingerprintSHA256(key)
+		if len(keyErr.Want) > 0 {
+			mismatch := &hostKeyMismatchError{
+				host:      hostname,
+				presented: fmt.Sprintf("%s %s", key.Type(), fingerprint),
+			}
+			for _, w := range keyErr.Want {
+				mismatch.expected = append(mismatch.expected, fmt.Sprintf("%s %s (%s:%d)", w.Key.Type(), ssh.FingerprintSHA256(w.Key), config.knownHosts, w.Line))
+			}
+			if config.strictHostKeyChecking == "no" {
+				fmt.Fprintf(os.Stderr, "WARNING: %s\n", mismatch)
+				return nil
+			}
+			return mismatch
+		}
+
+		if !config.acceptNewHostKey() {
+			return &hostKeyUnknownError{
+				host:        hostname,
+				fingerprint: fingerprint,
+			}
+		}
+		if err := appendKnownHost(config.fs, config.knownHosts, hostname, key); err != nil {
+			return fmt.Errorf("unable to add host key for %s: %w", hostname, err)
+		}
+		fmt.Fprintf(os.Stderr, "added host key for %s (%s %s) to %s\n", hostname, key.Type(), fingerprint, config.knownHosts)
+		return nil
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testAppendFs is testDialSshTunnelFs whose known_hosts can be appended.
+type testAppendFs struct {
+	testDialSshTunnelFs
+
+	mu         sync.Mutex
+	knownhosts *string
+}
+
+func (v *testAppendFs) Open(fname string) (fs.File, error) {
+	if fname == "/known_hosts" {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		if v.knownhosts == nil {
+			return nil, fs.ErrNotExist
+		}
+		return testDialSshTunnelFs{knownhosts: *v.knownhosts}.Open(fname)
+	}
+	return v.testDialSshTunnelFs.Open(fname)
+}
+
+func (v *testAppendFs) AppendFile(name string, b []byte) error {
+	if name != "/known_hosts" {
+		return fmt.Errorf("unexpected %s", name)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s := string(b)
+	if v.knownhosts != nil {
+		s = *v.knownhosts + s
+	}
+	v.knownhosts = &s
+	return nil
+}
+
+func TestDialSshTunnelStrictHostKeyChecking(t *testing.T) {
+	srv := startTestSshServer(t)
+	empty := ""
+	other := fmt.Sprintf("%s %s\n", srv.addr(), identityKeyPub)
+
+	tests := []struct {
+		name       string
+		mode       string
+		knownhosts *string
+		err        interface{}
+		added      bool
+	}{
+		{
+			name:       "yes_unknown",
+			mode:       "yes",
+			knownhosts: &empty,
+			err:        new(*hostKeyUnknownError),
+		},
+		{
+			name: "yes_no_known_hosts",
+			mode: "yes",
+			err:  &fs.ErrNotExist,
+		},
+		{
+			name:       "accept_new_unknown",
+			mode:       "accept-new",
+			knownhosts: &empty,
+			added:      true,
+		},
+		{
+			name:  "accept_new_no_known_hosts",
+			mode:  "accept-new",
+			added: true,
+		},
+		{
+			name:       "accept_new_mismatch",
+			mode:       "accept-new",
+			knownhosts: &other,
+			err:        new(*hostKeyMismatchError),
+		},
+		{
+			name:       "no_mismatch",
+			mode:       "no",
+			knownhosts: &other,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fsys := &testAppendFs{}
+			if test.knownhosts != nil {
+				kh := *test.knownhosts
+				fsys.knownhosts = &kh
+			}
+
+			config := sshTunnelSshConfig{
+				fs:                    fsys,
+				user:                  "guest",
+				idents:                []string{"/id_ed25519"},
+				addr:                  srv.addr(),
+				knownHosts:            "/known_hosts",
+				strictHostKeyChecking: test.mode,
+			}
+			tun, err := dialSshTunnel(config, ":22")
+			if test.err != nil {
+				if err == nil {
+					tun.Close()
+					t.Fatal("no error occurred.")
+				}
+				if target, ok := test.err.(*error); ok {
+					if !errors.Is(err, *target) {
+						t.Fatal(err)
+					}
+				} else if !errors.As(err, test.err) {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tun.Close()
+			testEcho(t, tun)
+
+			added := fsys.knownhosts != nil && strings.Contains(*fsys.knownhosts, serverHostKeyPub)
+			if added != test.added {
+				t.Fatalf("%v != %v", added, test.added)
+			}
+		})
+	}
+}
+
+func TestHostKeyMismatchError(t *testing.T) {
+	err := &hostKeyMismatchError{
+		host:      "example.com:22",
+		presented: "ssh-ed25519 SHA256:new",
+		expected:  []string{"ssh-ed25519 SHA256:old (/known_hosts:1)", "ssh-rsa SHA256:old (/known_hosts:2)"},
+	}
+	expect := "HOST KEY FOR example.com:22 HAS CHANGED: presented ssh-ed25519 SHA256:new, expected ssh-ed25519 SHA256:old (/known_hosts:1) or ssh-rsa SHA256:old (/known_hosts:2)"
+	if err.Error() != expect {
+		t.Fatalf("%s != %s", err, expect)
+	}
+}
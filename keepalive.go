@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshKeepAlive sends keepalive@openssh.com like ServerAliveInterval.
+// The client is closed after countMax requests are left unanswered.
+type sshKeepAlive struct {
+	mu  sync.Mutex
+	err error
+}
+
+func startSshKeepAlive(client *ssh.Client, interval time.Duration, countMax int) *sshKeepAlive {
+	k := &sshKeepAlive{}
+	if interval <= 0 {
+		return k
+	}
+
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		var missed int32
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+
+			if n := atomic.AddInt32(&missed, 1); int(n) > countMax {
+				// record before close. readers of the tunnel see EOF after this.
+				k.mu.Lock()
+				k.err = fmt.Errorf("ssh: no response to %d keepalives in %s", countMax, time.Duration(countMax)*interval)
+				k.mu.Unlock()
+				client.Close()
+				return
+			}
+
+			go func() {
+				// any reply, even a failure, means the transport is alive.
+				if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+					atomic.StoreInt32(&missed, 0)
+				}
+			}()
+		}
+	}()
+	return k
+}
+
+// Err returns non-nil if the client was closed by missing keepalives.
+func (k *sshKeepAlive) Err() error {
+	if k == nil {
+		return nil
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.err
+}
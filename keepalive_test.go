@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSshKeepAlive(t *testing.T) {
+	tests := []struct {
+		name   string
+		silent bool
+	}{
+		{
+			name: "alive",
+		},
+		{
+			name:   "dead",
+			silent: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := startTestSshServer(t)
+			if test.silent {
+				atomic.StoreInt32(&srv.silent, 1)
+			}
+			config := testSshClientPoolConfig(srv)
+			config.serverAliveInterval = 10 * time.Millisecond
+			config.serverAliveCountMax = 2
+
+			pool := newSshClientPool(time.Minute)
+			tun, err := pool.dialTunnel(config, ":5432")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tun.Close()
+
+			client, peer := net.Pipe()
+			defer peer.Close()
+
+			done := make(chan error, 1)
+			go func() {
+				done <- proxy(context.Background(), client, tun, copyRelay, copyRelay)
+			}()
+
+			select {
+			case <-done:
+				if !test.silent {
+					t.Fatal("alive tunnel closed.")
+				}
+				if tun.lost() == nil {
+					t.Fatal("no error occurred.")
+				}
+			case <-time.After(200 * time.Millisecond):
+				if test.silent {
+					t.Fatal("dead tunnel not closed.")
+				}
+				if err := tun.lost(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := listenUnix(dir, 5432, 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(unixSocketPath(dir, 5432))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o700 {
+		t.Fatalf("%o != 700", fi.Mode().Perm())
+	}
+
+	if _, err := listenUnix(dir, 5432, 0o700); err == nil {
+		t.Fatal("no error occurred.")
+	}
+
+	// left by killed process.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if _, err := os.Stat(unixSocketPath(dir, 5432)); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = listenUnix(dir, 5432, 0o777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := net.Dial("unix", unixSocketPath(dir, 5432))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestListenUnixNotSocket(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(unixSocketPath(dir, 5432), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := listenUnix(dir, 5432, 0o777); err == nil {
+		t.Fatal("no error occurred.")
+	}
+}
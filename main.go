@@ -1,35 +1,237 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/fs"
 	"net"
 	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/adrg/xdg"
 	homedir "github.com/mitchellh/go-homedir"
 	"golang.org/x/sync/errgroup"
 )
 
-func proxy(cx context.Context, c1, c2 io.ReadWriter) error {
-	eg, _ := errgroup.WithContext(cx)
+// relay copies messages from src to dst.
+type relay func(dst io.Writer, src io.Reader) error
+
+func copyRelay(dst io.Writer, src io.Reader) error {
+	_, err := io.Copy(dst, src)
+	return err
+}
+
+// messageHandler handles a message. it is passed to the next handler or written to w.
+type messageHandler func(w io.Writer, pkt *rawPacket) error
+
+func writeMessage(w io.Writer, pkt *rawPacket) error {
+	return pkt.write(w)
+}
+
+// relayMessages calls handle for every message up to maxSize. dst is flushed when src has no buffered message.
+func relayMessages(dst io.Writer, src io.Reader, maxSize uint32, handle messageHandler) error {
+	r := bufio.NewReader(src)
+	w := bufio.NewWriter(dst)
+	for {
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+
+		var pkt rawPacket
+		if err := pkt.read(r, maxSize); err != nil {
+			if err == io.EOF {
+				return w.Flush()
+			}
+			return err
+		}
+		if err := handle(w, &pkt); err != nil {
+			return err
+		}
+	}
+}
+
+func messageRelay(maxSize uint32, handle messageHandler) relay {
+	return func(dst io.Writer, src io.Reader) error {
+		return relayMessages(dst, src, maxSize, handle)
+	}
+}
+
+// proxy relays both directions until either ends. the other is cancelled by
+// closing up and expiring the read deadline of client.
+func proxy(cx context.Context, client net.Conn, up io.ReadWriteCloser, toClient, toUp relay) error {
+	cx, cancel := context.WithCancel(cx)
+	defer cancel()
+
+	var once sync.Once
+	var result error
+	done := func(err error) error {
+		once.Do(func() {
+			result = err
+			cancel()
+		})
+		return nil
+	}
+
+	eg, cx := errgroup.WithContext(cx)
 	eg.Go(func() error {
-		_, err := io.Copy(c1, c2)
-		return err
+		<-cx.Done()
+		client.SetReadDeadline(time.Now())
+		return up.Close()
 	})
 	eg.Go(func() error {
-		_, err := io.Copy(c2, c1)
-		return err
+		return done(toClient(client, up))
+	})
+	eg.Go(func() error {
+		return done(toUp(up, client))
 	})
-	return eg.Wait()
+	eg.Wait()
+	return result
+}
+
+// pgError is sent to the client as ErrorResponse with its severity and SQLSTATE.
+type pgError struct {
+	severity string
+	code     string
+	err      error
+}
+
+func (e *pgError) Error() string {
+	return e.err.Error()
+}
+
+func (e *pgError) Unwrap() error {
+	return e.err
+}
+
+// newErrorResponse builds ErrorResponse for err. XX000 unless err is pgError.
+func newErrorResponse(err error) *errorResponse {
+	severity, code := "ERROR", "XX000"
+	var pgErr *pgError
+	if errors.As(err, &pgErr) {
+		severity, code = pgErr.severity, pgErr.code
+	}
+	return &errorResponse{
+		fields: []errorResponseField{
+			{
+				code:  'S',
+				value: severity,
+			},
+			{
+				code:  'C',
+				value: code,
+			},
+			{
+				code:  'M',
+				value: err.Error(),
+			},
+			{
+				code:  'R',
+				value: "pg-ssh-proxy",
+			},
+		},
+	}
+}
+
+type server struct {
+	// swapped by reload. use currentConfig.
+	configMu sync.RWMutex
+	config   *config
+
+	pool    *sshClientPool
+	cancels *cancelRegistry
+	// answers 'S' to SSLRequest if not nil.
+	tls *tls.Config
+	// authenticates clients if not nil.
+	auth *clientAuth
+
+	sessions sync.WaitGroup
+
+	// listeners of entries with `listen` by entry name. changed by reload.
+	listenersMu sync.Mutex
+	dedicated   map[string]dedicatedListener
+	closed      bool
+	accepting   sync.WaitGroup
+}
+
+// cancel forwards CancelRequest with the real key over a new channel on the same ssh client.
+func (s *server) cancel(p *cancelRequest) error {
+	target, exists := s.cancels.lookup(backendKeyData{p.pid, p.secret})
+	if !exists {
+		// unknown key is ignored like postgres does.
+		return nil
+	}
+
+	up, err := s.pool.dialTunnel(newSshTunnelSshConfig(s.currentConfig().fs, &target.entry.Ssh), target.entry.Addr)
+	if err != nil {
+		return err
+	}
+	defer up.Close()
+
+	pkt := cancelRequest{target.key.pid, target.key.secret}
+	raw := pkt.toRaw()
+	if err := raw.write(up); err != nil {
+		return err
+	}
+	// postgres closes the connection after processing.
+	_, err = io.Copy(io.Discard, up)
+	return err
 }
 
-func serve(cx context.Context, conn net.Conn, config *config) error {
+// serve handles one client. the error is also sent to the client as ErrorResponse.
+// the client is routed to name if not empty. by the startup database otherwise.
+func (s *server) serve(cx context.Context, conn net.Conn, name string) (err error) {
+	defer func() {
+		if err == nil {
+			return
+		}
+		var pgErr *pgError
+		if cx.Err() != nil && !errors.As(err, &pgErr) {
+			// interrupted by the deadline below.
+			err = adminShutdown()
+		}
+		// conn may be upgraded to TLS.
+		raw := newErrorResponse(err).toRaw()
+		if werr := raw.write(conn); werr != nil {
+			fmt.Fprintln(os.Stderr, werr)
+		}
+	}()
+
+	// reads before the proxy starts, e.g. a client never sending StartupMessage, do not see cx.
+	// the deadline interrupts them on kill. writes to a client not reading give up too,
+	// leaving time for the ErrorResponse.
+	done := make(chan struct{})
+	defer close(done)
+	go func(conn net.Conn) {
+		select {
+		case <-cx.Done():
+			conn.SetReadDeadline(time.Now())
+			conn.SetWriteDeadline(time.Now().Add(killWriteTimeout))
+		case <-done:
+		}
+	}(conn)
+
+	// sessions keep the config at start even if reloaded.
+	conf := s.currentConfig()
+	// as sent by the client.
+	var clientUser, clientDatabase string
 	var up *sshTunnel
+	// up or TLS on it.
+	var upConn net.Conn
+	var entry *Connection
+	var tlsConn *tls.Conn
 	for up == nil {
 		var pkt rawInitialPacket
 		if err := pkt.read(conn); err != nil {
@@ -43,45 +245,200 @@ func serve(cx context.Context, conn net.Conn, config *config) error {
 
 		switch p := p2.(type) {
 		case *startupMessage:
-			var entry *Connection
+			role := p.params["user"]
+			clientUser = role
+			if s.auth != nil {
+				if err := s.auth.authenticate(conn, role); err != nil {
+					return err
+				}
+			}
 
 			if db := p.database(); db != nil {
-				c, exists := config.Connections[*db]
-				if exists {
-					entry = c
+				clientDatabase = *db
+				if name == "" {
+					name = *db
 				}
 			}
+			if c, exists := conf.Connections[name]; exists {
+				entry = c
+			}
 
 			if entry == nil {
 				return fmt.Errorf("No such connection.")
 			}
-			up, err = dialSshTunnel(sshTunnelSshConfig{
-				fs:         osfs{},
-				user:       entry.Ssh.User,
-				addr:       entry.Ssh.Addr,
-				idents:     entry.Ssh.Identity,
-				knownHosts: entry.Ssh.KnownHosts,
-			}, entry.Addr)
+			if s.auth != nil && !entry.allows(role) {
+				return &pgError{
+					severity: "FATAL",
+					code:     "28000",
+					err:      fmt.Errorf("role %q is not allowed to connect to %q", role, name),
+				}
+			}
+			if err := entry.Params.apply(p.params, role); err != nil {
+				return err
+			}
+			if entry.Readonly {
+				if err := readOnlyStartup(p.params, entry.Params.Set); err != nil {
+					return err
+				}
+			}
+			up, err = s.pool.dialTunnelContext(cx, newSshTunnelSshConfig(conf.fs, &entry.Ssh), entry.Addr)
 			if err != nil {
 				return err
 			}
 
+			upConn, err = startUpstreamTLS(up, entry, conf.fs)
+			if err != nil {
+				up.Close()
+				return err
+			}
+
 			p.setDataabse(entry.Dbname)
+			p.setUser(entry.upstreamUser(role))
 			raw := p.toRaw()
-			if err := raw.write(up); err != nil {
+			if err := raw.write(upConn); err != nil {
 				up.Close()
 				return err
 			}
 
+			if entry.injectsPassword() {
+				if err := authenticateUpstream(upConn, p.params["user"], entry); err != nil {
+					up.Close()
+					return err
+				}
+				// the client never sees the challenge.
+				ok := (&authentication{code: authenticationOk}).toRaw()
+				if err := ok.write(conn); err != nil {
+					up.Close()
+					return err
+				}
+			}
+
 		case *sslRequest:
+			if s.tls == nil || tlsConn != nil {
+				if _, err := conn.Write([]byte("N")); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := conn.Write([]byte("S")); err != nil {
+				return err
+			}
+			tlsConn = tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				// no ErrorResponse. the client does not speak plain protocol anymore.
+				fmt.Fprintf(os.Stderr, "tls: %s\n", err)
+				return nil
+			}
+			conn = tlsConn
+
+		case *gssencRequest:
+			// libpq retries with SSLRequest or plain StartupMessage.
 			if _, err := conn.Write([]byte("N")); err != nil {
 				return err
 			}
+
+		case *cancelRequest:
+			if err := s.cancel(p); err != nil {
+				fmt.Fprintf(os.Stderr, "cancel request: %s\n", err)
+			}
+			return nil
 		}
 	}
 	defer up.Close()
 
-	return proxy(cx, conn, up)
+	// messages are decoded only if needed. plain copy otherwise.
+	afterStartup, toUp := relay(copyRelay), relay(copyRelay)
+	frontend, backend := messageHandler(writeMessage), messageHandler(writeMessage)
+	// audit sees statements before rejected and errors after injected.
+	var guard *readOnlyGuard
+	if entry.Readonly {
+		guard = &readOnlyGuard{}
+		frontend = guard.frontend(frontend)
+	}
+	if entry.AuditLog != "" {
+		afs, ok := conf.fs.(openAppendFS)
+		if !ok {
+			return fmt.Errorf("%s: read-only", entry.AuditLog)
+		}
+		// opened once per session. a line is a single write to the file opened with O_APPEND.
+		fp, err := afs.OpenAppend(entry.AuditLog)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		audit := newAuditLog(func(line []byte) error {
+			_, err := fp.Write(line)
+			return err
+		}, conn.RemoteAddr().String(), clientUser, clientDatabase, name)
+		frontend = audit.frontend(frontend)
+		backend = audit.backend(backend)
+	}
+	if guard != nil {
+		backend = guard.backend(backend)
+	}
+	if entry.Readonly || entry.AuditLog != "" {
+		afterStartup, toUp = messageRelay(noMessageSizeLimit, backend), messageRelay(maxFrontendMessageSize, frontend)
+	}
+
+	// the real backend key never leaves the tunnel.
+	var synthetic *backendKeyData
+	toClient := func(dst io.Writer, src io.Reader) error {
+		return relayBackendKeyData(dst, src, func(key backendKeyData) backendKeyData {
+			k := s.cancels.register(entry, key)
+			synthetic = &k
+			return k
+		}, afterStartup)
+	}
+	err = proxy(cx, conn, upConn, toClient, toUp)
+	if synthetic != nil {
+		s.cancels.unregister(*synthetic)
+	}
+	if lost := up.lost(); lost != nil {
+		return &pgError{
+			severity: "FATAL",
+			code:     "08006",
+			err:      fmt.Errorf("ssh tunnel lost: %w", lost),
+		}
+	}
+	if cx.Err() != nil {
+		return adminShutdown()
+	}
+	return err
+}
+
+func adminShutdown() error {
+	return &pgError{
+		severity: "FATAL",
+		code:     "57P01",
+		err:      fmt.Errorf("terminating connection due to administrator command"),
+	}
+}
+
+func newSshTunnelSshConfig(fs fs.FS, conf *sshConnection) sshTunnelSshConfig {
+	r := sshTunnelSshConfig{
+		fs:         fs,
+		user:       conf.User,
+		addr:       conf.Addr,
+		idents:     conf.Identity,
+		knownHosts: conf.KnownHosts,
+		agent:      conf.Agent,
+
+		strictHostKeyChecking: conf.StrictHostKeyChecking,
+
+		passphraseEnv:     conf.PassphraseEnv,
+		passphraseCommand: conf.PassphraseCommand,
+
+		auth:                conf.Auth,
+		passwordCommand:     conf.PasswordCommand,
+		keyboardInteractive: conf.KeyboardInteractive,
+
+		serverAliveInterval: time.Duration(conf.ServerAliveInterval) * time.Second,
+		serverAliveCountMax: conf.ServerAliveCountMax,
+	}
+	for i := range conf.Jump {
+		r.jump = append(r.jump, newSshTunnelSshConfig(fs, &conf.Jump[i]))
+	}
+	return r
 }
 
 type osfs struct{}
@@ -93,60 +450,221 @@ func (osfs) Open(name string) (fs.File, error) {
 	return os.Open(name)
 }
 
+func (osfs) AppendFile(name string, b []byte) error {
+	fp, err := osfs{}.OpenAppend(name)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(b); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+func (osfs) OpenAppend(name string) (io.WriteCloser, error) {
+	if fname, err := homedir.Expand(name); err == nil {
+		name = fname
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o700); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+}
+
+// accept serves every connection from l until closed. routed to name if not empty.
+func (s *server) accept(cx context.Context, l net.Listener, name string) {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+
+		s.sessions.Add(1)
+		go func() {
+			defer s.sessions.Done()
+			defer conn.Close()
+			if err := s.serve(cx, conn, name); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}()
+	}
+}
+
+const (
+	// writes to clients after kill give up after this.
+	killWriteTimeout = time.Second
+	// sessions not finished in this after kill are abandoned. e.g. blocked by upstream.
+	killGracePeriod = 5 * time.Second
+)
+
+// drain waits sessions for timeout. then terminates them by kill, waits them for grace and closes ssh clients.
+func (s *server) drain(timeout, grace time.Duration, kill context.CancelFunc) {
+	drained := make(chan struct{})
+	go func() {
+		s.sessions.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		kill()
+		select {
+		case <-drained:
+		case <-time.After(grace):
+			fmt.Fprintln(os.Stderr, "sessions did not finish. closing ssh connections.")
+		}
+	}
+	s.pool.close()
+}
+
 func main() {
-	var addrFlag = flag.String("addr", "[::1]:5432", "listen address.")
+	var addrFlag = flag.String("addr", "[::1]:5432", "listen address. empty to disable.")
+	var unixSocketDirFlag = flag.String("unix-socket-dir", "", "also listen on .s.PGSQL.<port> in this directory. e.g. /tmp")
+	var unixSocketPortFlag = flag.Int("unix-socket-port", 5432, "port in the name of -unix-socket-dir socket.")
+	var unixSocketModeFlag = flag.String("unix-socket-mode", "0777", "permissions of -unix-socket-dir socket.")
 	var configFlag = flag.String("config", path.Join(xdg.ConfigHome, "pg-ssh-proxy.toml"), "config file.")
+	var sshIdleTimeoutFlag = flag.Duration("ssh-idle-timeout", 5*time.Minute, "close shared ssh connections after being unused for this long.")
+	var tlsCertFlag = flag.String("tls-cert", "", "certificate file. accepts SSLRequest from clients if set.")
+	var tlsKeyFlag = flag.String("tls-key", "", "private key file for -tls-cert.")
+	var tlsSelfSignedFlag = flag.Bool("tls-self-signed", false, "generate self-signed -tls-cert and -tls-key if not exist.")
+	var authFlag = flag.String("auth", "", "client authentication. trust (loopback only), md5 or scram-sha-256. every client is accepted if not set.")
+	var authFileFlag = flag.String("auth-file", "", "users file for -auth. \"role\" \"password\" per line like pgbouncer userlist.txt.")
+	var shutdownTimeoutFlag = flag.Duration("shutdown-timeout", 30*time.Second, "wait sessions for this long on SIGINT or SIGTERM. then terminated.")
+	var gssencFlag = flag.String("gssenc", "reject", "answer to GSSENCRequest. \"reject\" lets clients fall back. \"passthrough\" is reserved.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n  %s [flags]\n  %s [flags] check [-startup=false] [-user name] [-timeout 10s] [entry...]\n", os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	if *gssencFlag != "reject" {
+		fmt.Fprintf(os.Stderr, "-gssenc %s is not supported\n", *gssencFlag)
+		os.Exit(-1)
+	}
+
 	config, err := parseConfig(osfs{}, *configFlag)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(-1)
 	}
 
-	l, err := net.Listen("tcp", *addrFlag)
+	if flag.NArg() > 0 {
+		if flag.Arg(0) != "check" {
+			fmt.Fprintf(os.Stderr, "unknown command: %s\n", flag.Arg(0))
+			os.Exit(-1)
+		}
+		os.Exit(checkCommand(config, flag.Args()[1:]))
+	}
+
+	auth, err := loadClientAuth(osfs{}, *authFlag, *authFileFlag)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(-1)
 	}
-	defer l.Close()
+	if err := auth.validate(config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(-1)
+	}
 
-	for {
-		conn, err := l.Accept()
+	if *tlsSelfSignedFlag && *tlsCertFlag == "" {
+		*tlsCertFlag = path.Join(xdg.ConfigHome, "pg-ssh-proxy.crt")
+		*tlsKeyFlag = path.Join(xdg.ConfigHome, "pg-ssh-proxy.key")
+	}
+	tlsConfig, err := loadServerTLSConfig(*tlsCertFlag, *tlsKeyFlag, *tlsSelfSignedFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(-1)
+	}
+
+	// routed by the startup database. listeners of entries with `listen` are started by reload.
+	var listeners []net.Listener
+	if *addrFlag != "" {
+		l, err := net.Listen("tcp", *addrFlag)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
-			continue
+			os.Exit(-1)
+		}
+		listeners = append(listeners, l)
+	}
+	if *unixSocketDirFlag != "" {
+		mode, err := strconv.ParseUint(*unixSocketModeFlag, 8, 32)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -unix-socket-mode: %s\n", *unixSocketModeFlag)
+			os.Exit(-1)
 		}
+		l, err := listenUnix(*unixSocketDirFlag, *unixSocketPortFlag, os.FileMode(mode))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(-1)
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 && len(config.dedicated()) == 0 {
+		fmt.Fprintln(os.Stderr, "requires: -addr, -unix-socket-dir or `listen` of an entry")
+		os.Exit(-1)
+	}
 
-		go func() {
-			defer conn.Close()
-			if err := serve(context.TODO(), conn, config); err != nil {
-				pkt := &errorResponse{
-					fields: []errorResponseField{
-						{
-							code:  'S',
-							value: "ERROR",
-						},
-						{
-							code:  'C',
-							value: "XX000",
-						},
-						{
-							code:  'M',
-							value: err.Error(),
-						},
-						{
-							code:  'R',
-							value: "pg-ssh-proxy",
-						},
-					},
-				}
-				raw := pkt.toRaw()
-				if err := raw.write(conn); err != nil {
-					fmt.Fprintln(os.Stderr, err)
-				}
-				fmt.Fprintln(os.Stderr, err)
+	s := &server{
+		config:  config,
+		pool:    newSshClientPool(*sshIdleTimeoutFlag),
+		cancels: newCancelRegistry(),
+		tls:     tlsConfig,
+		auth:    auth,
+	}
+
+	cx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	// outlives cx for draining.
+	sessions, kill := context.WithCancel(context.Background())
+	defer kill()
+
+	// starts listeners of entries with `listen`.
+	if err := s.reload(sessions, config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(-1)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			next, err := parseConfig(osfs{}, *configFlag)
+			if err == nil {
+				err = auth.validate(next)
 			}
-		}()
+			if err == nil {
+				err = s.reload(sessions, next)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "reload: %s. keep the current config.\n", err)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "reload: %s\n", *configFlag)
+		}
+	}()
+
+	eg := errgroup.Group{}
+	for _, l := range listeners {
+		l := l
+		eg.Go(func() error {
+			s.accept(sessions, l, "")
+			return nil
+		})
+	}
+
+	<-cx.Done()
+	// second signal kills immediately.
+	stop()
+	fmt.Fprintf(os.Stderr, "shutting down. waiting sessions for %s\n", *shutdownTimeoutFlag)
+	for _, l := range listeners {
+		l.Close()
 	}
+	s.closeDedicated()
+	eg.Wait()
+	s.drain(*shutdownTimeoutFlag, killGracePeriod, kill)
 }
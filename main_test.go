@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTestPostgres runs fake postgres. handle is called for every accepted connection.
+func startTestPostgres(t *testing.T, handle func(conn net.Conn)) string {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// newTestServer returns server which routes every entry in connections through srv.
+func newTestServer(srv *testSshServer, connections map[string]*Connection) *server {
+	for _, c := range connections {
+		c.Ssh.Addr = srv.addr()
+		c.Ssh.User = "guest"
+		c.Ssh.Identity = []string{"/id_ed25519"}
+		c.Ssh.KnownHosts = "/known_hosts"
+	}
+	return &server{
+		config: &config{
+			fs: testDialSshTunnelFs{
+				knownhosts: srv.knownhosts(),
+			},
+			Connections: connections,
+		},
+		pool:    newSshClientPool(time.Minute),
+		cancels: newCancelRegistry(),
+	}
+}
+
+// testServe serves one client connection and returns the client side.
+func testServe(t *testing.T, s *server) net.Conn {
+	client, conn := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	go func() {
+		defer conn.Close()
+		s.serve(context.Background(), conn, "")
+	}()
+	return client
+}
+
+func TestServeGssencRequest(t *testing.T) {
+	pg := startTestPostgres(t, handleTestPostgresReady)
+	s := newTestServer(startTestSshJumpServer(t), map[string]*Connection{
+		"db": {
+			Addr:   pg,
+			Dbname: "db",
+		},
+	})
+
+	client := testServe(t, s)
+	req := (&gssencRequest{}).toRaw()
+	if err := req.write(client); err != nil {
+		t.Fatal(err)
+	}
+	answer := make([]byte, 1)
+	if _, err := io.ReadFull(client, answer); err != nil {
+		t.Fatal(err)
+	}
+	if answer[0] != 'N' {
+		t.Fatalf("%c != N", answer[0])
+	}
+
+	// fall back to plain startup.
+	startup := (&startupMessage{map[string]string{"database": "db", "user": "guest"}}).toRaw()
+	if err := startup.write(client); err != nil {
+		t.Fatal(err)
+	}
+	var pkt rawPacket
+	if err := pkt.read(client, noMessageSizeLimit); err != nil {
+		t.Fatal(err)
+	}
+	if pkt.header != 'R' {
+		t.Fatalf("%c != R", pkt.header)
+	}
+}
+
+func TestServeDedicatedListener(t *testing.T) {
+	pg := startTestPostgres(t, handleTestPostgresReady)
+	s := newTestServer(startTestSshJumpServer(t), map[string]*Connection{
+		"db": {
+			Addr:   pg,
+			Dbname: "db",
+		},
+	})
+
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.accept(context.Background(), l, "db")
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// whatever the database is.
+	startup := (&startupMessage{map[string]string{"database": "reporting", "user": "guest"}}).toRaw()
+	if err := startup.write(client); err != nil {
+		t.Fatal(err)
+	}
+	var pkt rawPacket
+	if err := pkt.read(client, noMessageSizeLimit); err != nil {
+		t.Fatal(err)
+	}
+	if pkt.header != 'R' {
+		t.Fatalf("%c != R", pkt.header)
+	}
+}
+
+func TestServerDrain(t *testing.T) {
+	pg := startTestPostgres(t, handleTestPostgresReady)
+	s := newTestServer(startTestSshJumpServer(t), map[string]*Connection{
+		"db": {
+			Addr:   pg,
+			Dbname: "db",
+		},
+	})
+
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, kill := context.WithCancel(context.Background())
+	defer kill()
+	accepted := make(chan struct{})
+	go func() {
+		s.accept(sessions, l, "")
+		close(accepted)
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	startup := (&startupMessage{map[string]string{"database": "db", "user": "guest"}}).toRaw()
+	if err := startup.write(client); err != nil {
+		t.Fatal(err)
+	}
+	for _, wants := range []byte("RZ") {
+		var pkt rawPacket
+		if err := pkt.read(client, noMessageSizeLimit); err != nil {
+			t.Fatal(err)
+		}
+		if pkt.header != wants {
+			t.Fatalf("%c != %c", pkt.header, wants)
+		}
+	}
+
+	l.Close()
+	<-accepted
+	s.drain(10*time.Millisecond, time.Second, kill)
+
+	var pkt rawPacket
+	if err := pkt.read(client, noMessageSizeLimit); err != nil {
+		t.Fatal(err)
+	}
+	e, err := parseErrorResponse(&pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := e.get('C'); code != "57P01" {
+		t.Fatalf("%s != 57P01", code)
+	}
+
+	s.pool.mu.Lock()
+	n := len(s.pool.clients)
+	s.pool.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d != 0", n)
+	}
+}
+
+func TestServerDrainBeforeStartup(t *testing.T) {
+	s := newTestServer(startTestSshJumpServer(t), map[string]*Connection{})
+
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, kill := context.WithCancel(context.Background())
+	defer kill()
+	accepted := make(chan struct{})
+	go func() {
+		s.accept(sessions, l, "")
+		close(accepted)
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// the session is started. then never sends StartupMessage.
+	req := (&gssencRequest{}).toRaw()
+	if err := req.write(client); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(client, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	l.Close()
+	<-accepted
+	drained := make(chan struct{})
+	go func() {
+		s.drain(10*time.Millisecond, time.Second, kill)
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain does not return")
+	}
+
+	var pkt rawPacket
+	if err := pkt.read(client, noMessageSizeLimit); err != nil {
+		t.Fatal(err)
+	}
+	e, err := parseErrorResponse(&pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := e.get('C'); code != "57P01" {
+		t.Fatalf("%s != 57P01", code)
+	}
+}
+
+// testDrain runs drain and fails unless it returns in time.
+func testDrain(t *testing.T, s *server, grace time.Duration, kill context.CancelFunc) {
+	drained := make(chan struct{})
+	go func() {
+		s.drain(10*time.Millisecond, grace, kill)
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain does not return")
+	}
+}
+
+func TestServerDrainDialing(t *testing.T) {
+	// accepts and never answers ssh handshake.
+	silent, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { silent.Close() })
+	dialed := make(chan struct{})
+	go func() {
+		conn, err := silent.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		close(dialed)
+	}()
+
+	s := newTestServer(&testSshServer{l: silent}, map[string]*Connection{
+		"db": {
+			Addr:   ":5432",
+			Dbname: "db",
+		},
+	})
+	sessions, kill := context.WithCancel(context.Background())
+	defer kill()
+	client, conn := net.Pipe()
+	defer client.Close()
+	s.sessions.Add(1)
+	go func() {
+		defer s.sessions.Done()
+		defer conn.Close()
+		s.serve(sessions, conn, "")
+	}()
+
+	startup := (&startupMessage{map[string]string{"database": "db", "user": "guest"}}).toRaw()
+	if err := startup.write(client); err != nil {
+		t.Fatal(err)
+	}
+	<-dialed
+	var pkt rawPacket
+	read := make(chan error, 1)
+	go func() {
+		read <- pkt.read(client, noMessageSizeLimit)
+	}()
+	testDrain(t, s, 5*time.Second, kill)
+
+	if err := <-read; err != nil {
+		t.Fatal(err)
+	}
+	e, err := parseErrorResponse(&pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := e.get('C'); code != "57P01" {
+		t.Fatalf("%s != 57P01", code)
+	}
+}
+
+func TestServerDrainGrace(t *testing.T) {
+	// reads StartupMessage and never asks authentication.
+	started := make(chan struct{}, 1)
+	pg := startTestPostgres(t, func(conn net.Conn) {
+		var pkt rawInitialPacket
+		if err := pkt.read(conn); err != nil {
+			return
+		}
+		started <- struct{}{}
+		io.Copy(io.Discard, conn)
+	})
+	s := newTestServer(startTestSshJumpServer(t), map[string]*Connection{
+		"db": {
+			Addr:     pg,
+			Dbname:   "db",
+			Password: "secret",
+		},
+	})
+	sessions, kill := context.WithCancel(context.Background())
+	defer kill()
+	client, conn := net.Pipe()
+	defer client.Close()
+	s.sessions.Add(1)
+	go func() {
+		defer s.sessions.Done()
+		defer conn.Close()
+		s.serve(sessions, conn, "")
+	}()
+
+	startup := (&startupMessage{map[string]string{"database": "db", "user": "guest"}}).toRaw()
+	if err := startup.write(client); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	// the session waits upstream, which does not see kill.
+	testDrain(t, s, 100*time.Millisecond, kill)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// startupParams rewrites parameters of StartupMessage. `%u` in values is client's user.
+type startupParams struct {
+	// always overrides.
+	Set map[string]string `toml:"set"`
+	// used if the client does not send.
+	Default map[string]string `toml:"default"`
+	// clients sending these are rejected.
+	Forbid []string `toml:"forbid"`
+}
+
+// managed by `dbname` and `user`.
+var reservedStartupParams = map[string]bool{
+	"database": true,
+	"user":     true,
+}
+
+func (p *startupParams) clarify() error {
+	for _, v := range []struct {
+		name string
+		keys []string
+	}{
+		{"params.set", mapKeys(p.Set)},
+		{"params.default", mapKeys(p.Default)},
+		{"params.forbid", p.Forbid},
+	} {
+		for _, k := range v.keys {
+			if reservedStartupParams[k] {
+				return fmt.Errorf("invalid `%s`: %s", v.name, k)
+			}
+		}
+	}
+	for _, k := range p.Forbid {
+		if _, exists := p.Set[k]; exists {
+			return fmt.Errorf("`params.set` and `params.forbid` are exclusive: %s", k)
+		}
+	}
+	return nil
+}
+
+func mapKeys(m map[string]string) []string {
+	r := make([]string, 0, len(m))
+	for k := range m {
+		r = append(r, k)
+	}
+	return r
+}
+
+func expandStartupParam(v, user string) string {
+	return strings.NewReplacer("%u", user, "%%", "%").Replace(v)
+}
+
+// startupParamName returns the name postgres looks up. parameters other than the
+// ones handled by postgres itself are GUCs, whose names are case-insensitive.
+func startupParamName(k string) string {
+	switch k {
+	case "database", "user", "options", "replication":
+		return k
+	}
+	return strings.ToLower(k)
+}
+
+// startupOptionNames returns names set by `-c name=value` or `--name=value` in options.
+// split like pg_split_opts. dashes in names are underscores like ParseLongOption.
+func startupOptionNames(options string) []string {
+	var args []string
+	arg := strings.Builder{}
+	escaped, started := false, false
+	for _, c := range options {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped, started = true, true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			if started {
+				args = append(args, arg.String())
+				arg.Reset()
+				started = false
+			}
+		default:
+			arg.WriteRune(c)
+			started = true
+		}
+	}
+	if started {
+		args = append(args, arg.String())
+	}
+
+	var names []string
+	for i := 0; i < len(args); i++ {
+		var opt string
+		switch {
+		case args[i] == "-c" && i+1 < len(args):
+			i++
+			opt = args[i]
+		case strings.HasPrefix(args[i], "--"):
+			opt = args[i][2:]
+		case strings.HasPrefix(args[i], "-c"):
+			opt = args[i][2:]
+		default:
+			continue
+		}
+		if name := strings.SplitN(opt, "=", 2)[0]; name != "" {
+			names = append(names, strings.ToLower(strings.ReplaceAll(name, "-", "_")))
+		}
+	}
+	return names
+}
+
+// sentStartupParams returns names of params including the ones in options.
+func sentStartupParams(params map[string]string) map[string]bool {
+	r := map[string]bool{}
+	for k := range params {
+		r[startupParamName(k)] = true
+	}
+	for _, n := range startupOptionNames(params["options"]) {
+		r[n] = true
+	}
+	return r
+}
+
+// apply rewrites params in place. fails if any forbidden one is sent.
+func (p *startupParams) apply(params map[string]string, user string) error {
+	sent := sentStartupParams(params)
+	for _, k := range p.Forbid {
+		if sent[startupParamName(k)] {
+			return &pgError{
+				severity: "FATAL",
+				code:     "42501",
+				err:      fmt.Errorf("parameter %q is not allowed", k),
+			}
+		}
+	}
+	for k, v := range p.Default {
+		if !sent[startupParamName(k)] {
+			params[k] = expandStartupParam(v, user)
+		}
+	}
+	for k, v := range p.Set {
+		// drop the client's spelling. both would be sent otherwise.
+		for ck := range params {
+			if startupParamName(ck) == startupParamName(k) {
+				delete(params, ck)
+			}
+		}
+		params[k] = expandStartupParam(v, user)
+	}
+	return nil
+}
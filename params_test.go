@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestStartupParamsApply(t *testing.T) {
+	params := startupParams{
+		Set: map[string]string{
+			"application_name": "psql (%u)",
+			"options":          "-c default_transaction_read_only=on",
+		},
+		Default: map[string]string{
+			"statement_timeout": "30s",
+			"DateStyle":         "ISO",
+		},
+		Forbid: []string{
+			"replication",
+			"default_transaction_read_only",
+		},
+	}
+
+	tests := []struct {
+		name  string
+		input map[string]string
+		wants map[string]string
+		code  string
+	}{
+		{
+			name: "apply",
+			input: map[string]string{
+				"user":             "alice",
+				"application_name": "psql",
+				"DateStyle":        "German",
+			},
+			wants: map[string]string{
+				"user":              "alice",
+				"application_name":  "psql (alice)",
+				"options":           "-c default_transaction_read_only=on",
+				"statement_timeout": "30s",
+				"DateStyle":         "German",
+			},
+		},
+		{
+			name: "forbid",
+			input: map[string]string{
+				"user":        "alice",
+				"replication": "database",
+			},
+			code: "42501",
+		},
+		{
+			name: "forbid_case",
+			input: map[string]string{
+				"user":                          "alice",
+				"DEFAULT_TRANSACTION_READ_ONLY": "off",
+			},
+			code: "42501",
+		},
+		{
+			name: "forbid_options",
+			input: map[string]string{
+				"user":    "alice",
+				"options": "-c default_transaction_read_only=off",
+			},
+			code: "42501",
+		},
+		{
+			name: "forbid_options_dash",
+			input: map[string]string{
+				"user":    "alice",
+				"options": "--Default-Transaction-Read-Only=off",
+			},
+			code: "42501",
+		},
+		{
+			name: "case",
+			input: map[string]string{
+				"user":              "alice",
+				"Statement_Timeout": "0",
+				"Application_Name":  "psql",
+			},
+			wants: map[string]string{
+				"user":              "alice",
+				"application_name":  "psql (alice)",
+				"options":           "-c default_transaction_read_only=on",
+				"Statement_Timeout": "0",
+				"DateStyle":         "ISO",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := params.apply(test.input, "alice")
+			if test.code != "" {
+				var pgErr *pgError
+				if !errors.As(err, &pgErr) || pgErr.code != test.code {
+					t.Fatalf("%v != %s", err, test.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(test.input, test.wants) {
+				t.Fatalf("%v != %v", test.input, test.wants)
+			}
+		})
+	}
+}
+
+func TestStartupOptionNames(t *testing.T) {
+	actual := startupOptionNames(`-c search_path=a\ b  -cwork_mem=1MB --statement-timeout=0 -B 10 -c`)
+	wants := []string{"search_path", "work_mem", "statement_timeout"}
+	if !reflect.DeepEqual(actual, wants) {
+		t.Fatalf("%v != %v", actual, wants)
+	}
+}
+
+func TestExpandStartupParam(t *testing.T) {
+	if v := expandStartupParam("%u 100%% %x", "alice"); v != "alice 100% %x" {
+		t.Fatal(v)
+	}
+}
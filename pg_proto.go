@@ -6,9 +6,21 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"sort"
 )
 
+const (
+	// MAX_STARTUP_PACKET_LENGTH of postgres.
+	maxStartupPacketSize = 10000
+	// PG_MAX_AUTH_TOKEN_LENGTH of postgres. read before the client is authenticated.
+	maxAuthMessageSize = 65535
+	// PQ_LARGE_MESSAGE_LIMIT of postgres. for frontend messages after the startup.
+	maxFrontendMessageSize = 0x3fffffff
+	// for backend messages.
+	noMessageSizeLimit = math.MaxUint32
+)
+
 func read32(r io.Reader) (uint32, error) {
 	var b [4]byte
 	if _, err := io.ReadFull(r, b[:]); err != nil {
@@ -18,6 +30,15 @@ func read32(r io.Reader) (uint32, error) {
 	return binary.BigEndian.Uint32(b[:]), nil
 }
 
+func read16(r io.Reader) (uint16, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint16(b[:]), nil
+}
+
 func write32(w io.Writer, v uint32) error {
 	var b [4]byte
 	binary.BigEndian.PutUint32(b[:], v)
@@ -66,6 +87,9 @@ func (p *rawInitialPacket) read(r io.Reader) error {
 	if size < 4 {
 		return fmt.Errorf("invalid packet size")
 	}
+	if size-4 > maxStartupPacketSize {
+		return fmt.Errorf("invalid startup packet size: %d", size)
+	}
 
 	pkt := make([]byte, size-4)
 	if _, err := io.ReadFull(r, pkt); err != nil {
@@ -125,6 +149,20 @@ func (p *rawInitialPacket) toConcrete() (initialPacket, error) {
 	case 80877103:
 		return &sslRequest{}, nil
 
+	case 80877104:
+		return &gssencRequest{}, nil
+
+	case 80877102:
+		pid, err := read32(b)
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		secret, err := read32(b)
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return &cancelRequest{pid, secret}, nil
+
 	default:
 		return nil, fmt.Errorf("unknown packet.")
 	}
@@ -151,6 +189,10 @@ func (v *startupMessage) setDataabse(name string) {
 	v.params["database"] = name
 }
 
+func (v *startupMessage) setUser(name string) {
+	v.params["user"] = name
+}
+
 func (v *startupMessage) toRaw() rawInitialPacket {
 	b := &bytes.Buffer{}
 
@@ -179,11 +221,67 @@ func (v *sslRequest) toRaw() rawInitialPacket {
 	return rawInitialPacket(b.Bytes())
 }
 
+type gssencRequest struct{}
+
+func (v *gssencRequest) toRaw() rawInitialPacket {
+	b := &bytes.Buffer{}
+
+	must(write32(b, 80877104))
+	return rawInitialPacket(b.Bytes())
+}
+
+type cancelRequest struct {
+	pid    uint32
+	secret uint32
+}
+
+func (v *cancelRequest) toRaw() rawInitialPacket {
+	b := &bytes.Buffer{}
+
+	must(write32(b, 80877102))
+	must(write32(b, v.pid))
+	must(write32(b, v.secret))
+	return rawInitialPacket(b.Bytes())
+}
+
 type rawPacket struct {
 	header byte
 	data   []byte
 }
 
+// read reads a message. fails before allocation if longer than maxSize.
+func (p *rawPacket) read(r io.Reader, maxSize uint32) error {
+	var h [1]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return err
+	}
+
+	size, err := read32(r)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if size < 4 {
+		return fmt.Errorf("invalid packet size")
+	}
+	if size-4 > maxSize {
+		return fmt.Errorf("message %q too large: %d", h[0], size)
+	}
+
+	data := make([]byte, size-4)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	p.header = h[0]
+	p.data = data
+	return nil
+}
+
 func (p *rawPacket) write(w io.Writer) error {
 	if _, err := w.Write([]byte{p.header}); err != nil {
 		return err
@@ -224,3 +322,141 @@ func (v *errorResponse) toRaw() rawPacket {
 		data:   b.Bytes(),
 	}
 }
+
+type backendKeyData struct {
+	pid    uint32
+	secret uint32
+}
+
+func parseBackendKeyData(p *rawPacket) (*backendKeyData, error) {
+	if p.header != 'K' || len(p.data) != 8 {
+		return nil, fmt.Errorf("invalid BackendKeyData")
+	}
+	return &backendKeyData{
+		pid:    binary.BigEndian.Uint32(p.data[0:4]),
+		secret: binary.BigEndian.Uint32(p.data[4:8]),
+	}, nil
+}
+
+func (v *backendKeyData) toRaw() rawPacket {
+	b := &bytes.Buffer{}
+
+	must(write32(b, v.pid))
+	must(write32(b, v.secret))
+	return rawPacket{
+		header: 'K',
+		data:   b.Bytes(),
+	}
+}
+
+func (v *errorResponse) get(code byte) string {
+	for _, f := range v.fields {
+		if f.code == code {
+			return f.value
+		}
+	}
+	return ""
+}
+
+func parseErrorResponse(p *rawPacket) (*errorResponse, error) {
+	if p.header != 'E' && p.header != 'N' {
+		return nil, fmt.Errorf("invalid ErrorResponse")
+	}
+
+	b := bytes.NewBuffer(p.data)
+	v := &errorResponse{}
+	for {
+		code, err := b.ReadByte()
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if code == 0 {
+			return v, nil
+		}
+		value, err := readString(b)
+		if err != nil {
+			return nil, err
+		}
+		v.fields = append(v.fields, errorResponseField{code, value})
+	}
+}
+
+const (
+	authenticationOk                = 0
+	authenticationCleartextPassword = 3
+	authenticationMD5Password       = 5
+	authenticationSASL              = 10
+	authenticationSASLContinue      = 11
+	authenticationSASLFinal         = 12
+)
+
+// authentication is the family of Authentication* messages. data follows the code.
+type authentication struct {
+	code uint32
+	data []byte
+}
+
+func parseAuthentication(p *rawPacket) (*authentication, error) {
+	if p.header != 'R' || len(p.data) < 4 {
+		return nil, fmt.Errorf("invalid Authentication")
+	}
+	return &authentication{
+		code: binary.BigEndian.Uint32(p.data[0:4]),
+		data: p.data[4:],
+	}, nil
+}
+
+func (v *authentication) toRaw() rawPacket {
+	b := &bytes.Buffer{}
+
+	must(write32(b, v.code))
+	b.Write(v.data)
+	return rawPacket{
+		header: 'R',
+		data:   b.Bytes(),
+	}
+}
+
+// mechanisms of AuthenticationSASL.
+func (v *authentication) mechanisms() ([]string, error) {
+	b := bytes.NewBuffer(v.data)
+	var r []string
+	for {
+		m, err := readString(b)
+		if err != nil {
+			return nil, err
+		}
+		if m == "" {
+			return r, nil
+		}
+		r = append(r, m)
+	}
+}
+
+// passwordMessage is PasswordMessage, SASLInitialResponse or SASLResponse.
+type passwordMessage struct {
+	data []byte
+}
+
+func newPasswordMessage(password string) *passwordMessage {
+	b := &bytes.Buffer{}
+
+	must(writeString(b, password))
+	return &passwordMessage{b.Bytes()}
+}
+
+func newSASLInitialResponse(mechanism string, response []byte) *passwordMessage {
+	b := &bytes.Buffer{}
+
+	must(writeString(b, mechanism))
+	must(write32(b, uint32(len(response))))
+	b.Write(response)
+	return &passwordMessage{b.Bytes()}
+}
+
+func (v *passwordMessage) toRaw() rawPacket {
+	return rawPacket{
+		header: 'p',
+		data:   v.data,
+	}
+}
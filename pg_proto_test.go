@@ -297,6 +297,11 @@ func TestRawInitialPacketRead(t *testing.T) {
 			data: []byte{0x00, 0x00, 0x00, 0x03},
 			err:  "invalid packet size",
 		},
+		{
+			name: "test too large",
+			data: []byte{0x7F, 0xFF, 0xFF, 0xFF},
+			err:  "invalid startup packet size: 2147483647",
+		},
 	}
 
 	for _, test := range tests {
@@ -411,6 +416,19 @@ func TestSerde(t *testing.T) {
 				0x00, 0x00, 0x00, 0x08, 0x04, 0xd2, 0x16, 0x2f,
 			},
 		},
+		{
+			"gssencRequest",
+			[]byte{
+				0x00, 0x00, 0x00, 0x08, 0x04, 0xd2, 0x16, 0x30,
+			},
+		},
+		{
+			"cancelRequest",
+			[]byte{
+				0x00, 0x00, 0x00, 0x10, 0x04, 0xd2, 0x16, 0x2e,
+				0x00, 0x00, 0x04, 0xd2, 0x00, 0x00, 0x16, 0x2e,
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -461,6 +479,11 @@ func TestToConcreteErr(t *testing.T) {
 			data: rawInitialPacket{0x00, 0x03, 0x00, 0x00, 0x01, 0x00, 0x01},
 			err:  "unexpected EOF",
 		},
+		{
+			name: "cancel_eof",
+			data: rawInitialPacket{0x04, 0xd2, 0x16, 0x2e, 0x00, 0x00, 0x04, 0xd2},
+			err:  "unexpected EOF",
+		},
 	}
 
 	for _, test := range tests {
@@ -476,6 +499,17 @@ func TestToConcreteErr(t *testing.T) {
 	}
 }
 
+func TestToConcreteGssencRequest(t *testing.T) {
+	pkt := rawInitialPacket{0x04, 0xd2, 0x16, 0x30}
+	p, err := pkt.toConcrete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.(*gssencRequest); !ok {
+		t.Fatalf("%#v", p)
+	}
+}
+
 func TestStartupMessageDatabase(t *testing.T) {
 	if (&startupMessage{map[string]string{}}).database() != nil {
 		t.Fail()
@@ -493,6 +527,60 @@ func TestStartupMessageSetDatabase(t *testing.T) {
 	}
 }
 
+func TestStartupMessageSetUser(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry Connection
+		wants map[string]string
+	}{
+		{
+			name:  "passthrough",
+			entry: Connection{Dbname: "upstream"},
+			wants: map[string]string{"database": "upstream", "user": "alice", "application_name": "psql"},
+		},
+		{
+			name:  "user",
+			entry: Connection{Dbname: "upstream", User: "app"},
+			wants: map[string]string{"database": "upstream", "user": "app", "application_name": "psql"},
+		},
+		{
+			name:  "user_map",
+			entry: Connection{Dbname: "upstream", User: "app", UserMap: map[string]string{"alice": "app_ro"}},
+			wants: map[string]string{"database": "upstream", "user": "app_ro", "application_name": "psql"},
+		},
+		{
+			name:  "user_map_miss",
+			entry: Connection{Dbname: "upstream", UserMap: map[string]string{"bob": "app_ro"}},
+			wants: map[string]string{"database": "upstream", "user": "alice", "application_name": "psql"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &startupMessage{map[string]string{"database": "local", "user": "alice", "application_name": "psql"}}
+			m.setDataabse(test.entry.Dbname)
+			m.setUser(test.entry.upstreamUser(m.params["user"]))
+
+			raw := m.toRaw()
+			b := &bytes.Buffer{}
+			if err := raw.write(b); err != nil {
+				t.Fatal(err)
+			}
+			var pkt rawInitialPacket
+			if err := pkt.read(b); err != nil {
+				t.Fatal(err)
+			}
+			p, err := pkt.toConcrete()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := p.(*startupMessage).params; !reflect.DeepEqual(actual, test.wants) {
+				t.Fatalf("%v != %v", actual, test.wants)
+			}
+		})
+	}
+}
+
 func TestMust(t *testing.T) {
 	defer func() {
 		err := recover()
@@ -539,6 +627,94 @@ func TestRawPacketWrite(t *testing.T) {
 	}
 }
 
+func TestRawPacketRead(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		maxSize uint32
+		wants   rawPacket
+		err     string
+	}{
+		{
+			name:  "empty",
+			data:  []byte{0xFF, 0x00, 0x00, 0x00, 0x04},
+			wants: rawPacket{0xFF, []byte{}},
+		},
+		{
+			name:  "size1",
+			data:  []byte{0xFF, 0x00, 0x00, 0x00, 0x05, 0xEE},
+			wants: rawPacket{0xFF, []byte{0xEE}},
+		},
+		{
+			name: "EOF",
+			data: []byte{},
+			err:  "EOF",
+		},
+		{
+			name: "EOF header",
+			data: []byte{0xFF},
+			err:  "unexpected EOF",
+		},
+		{
+			name: "EOF data",
+			data: []byte{0xFF, 0x00, 0x00, 0x00, 0x05},
+			err:  "unexpected EOF",
+		},
+		{
+			name: "invalid packet size",
+			data: []byte{0xFF, 0x00, 0x00, 0x00, 0x03},
+			err:  "invalid packet size",
+		},
+		{
+			name:    "max size",
+			data:    []byte{0xFF, 0x00, 0x00, 0x00, 0x05, 0xEE},
+			maxSize: 1,
+			wants:   rawPacket{0xFF, []byte{0xEE}},
+		},
+		{
+			name:    "too large",
+			data:    []byte{'p', 0xFF, 0xFF, 0xFF, 0xFF},
+			maxSize: maxAuthMessageSize,
+			err:     "message 'p' too large: 4294967295",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			maxSize := test.maxSize
+			if maxSize == 0 {
+				maxSize = noMessageSizeLimit
+			}
+			var pkt rawPacket
+			if err := pkt.read(bytes.NewBuffer(test.data), maxSize); err != nil {
+				if test.err == "" || test.err != err.Error() {
+					t.Fatal(err)
+				}
+				return
+			}
+			if test.err != "" {
+				t.Fail()
+			}
+			if !reflect.DeepEqual(pkt, test.wants) {
+				t.Fatalf("%#v != %#v", pkt, test.wants)
+			}
+		})
+	}
+}
+
+func TestParseBackendKeyData(t *testing.T) {
+	v, err := parseBackendKeyData(&rawPacket{'K', []byte{0, 0, 0, 1, 0, 0, 0, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *v != (backendKeyData{1, 2}) {
+		t.Fatal(v)
+	}
+	if _, err := parseBackendKeyData(&rawPacket{'K', []byte{0, 0, 0, 1}}); err == nil {
+		t.Fatal("no error occurred.")
+	}
+}
+
 func TestRawlPacketWriteErr1(t *testing.T) {
 	r, w := io.Pipe()
 	go func() {
@@ -611,6 +787,21 @@ func TestPacketToRaw(t *testing.T) {
 			},
 			rawPacket{'E', []byte{0x4d, 0x4f, 0x4b, 0x00, 0x00}},
 		},
+		{
+			"authenticationOk",
+			&authentication{code: authenticationOk},
+			rawPacket{'R', []byte{0x00, 0x00, 0x00, 0x00}},
+		},
+		{
+			"passwordMessage",
+			newPasswordMessage("pw"),
+			rawPacket{'p', []byte{'p', 'w', 0x00}},
+		},
+		{
+			"saslInitialResponse",
+			newSASLInitialResponse("M", []byte("ab")),
+			rawPacket{'p', []byte{'M', 0x00, 0x00, 0x00, 0x00, 0x02, 'a', 'b'}},
+		},
 	}
 
 	for _, test := range tests {
@@ -622,3 +813,40 @@ func TestPacketToRaw(t *testing.T) {
 		})
 	}
 }
+
+func TestParseErrorResponse(t *testing.T) {
+	v, err := parseErrorResponse(&rawPacket{'E', []byte("SFATAL\x00C28P01\x00Mfailed\x00\x00")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.get('S') != "FATAL" || v.get('C') != "28P01" || v.get('M') != "failed" || v.get('D') != "" {
+		t.Fatal(v)
+	}
+
+	for _, data := range []string{"", "SFATAL", "SFATAL\x00"} {
+		if _, err := parseErrorResponse(&rawPacket{'E', []byte(data)}); err == nil {
+			t.Fatalf("no error occurred: %q", data)
+		}
+	}
+}
+
+func TestParseAuthentication(t *testing.T) {
+	v, err := parseAuthentication(&rawPacket{'R', []byte("\x00\x00\x00\x0aSCRAM-SHA-256-PLUS\x00SCRAM-SHA-256\x00\x00")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.code != authenticationSASL {
+		t.Fatal(v.code)
+	}
+	mechanisms, err := v.mechanisms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mechanisms, []string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256"}) {
+		t.Fatal(mechanisms)
+	}
+
+	if _, err := parseAuthentication(&rawPacket{'R', []byte{0x00}}); err == nil {
+		t.Fatal("no error occurred.")
+	}
+}
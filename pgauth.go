@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// injectsPassword reports whether the proxy answers upstream authentication.
+func (c *Connection) injectsPassword() bool {
+	return c.Password != "" || c.PasswordCommand != ""
+}
+
+func (c *Connection) password() (string, error) {
+	if c.PasswordCommand != "" {
+		return runSecretCommand(c.PasswordCommand)
+	}
+	return c.Password, nil
+}
+
+// upstreamError converts ErrorResponse from upstream to pgError.
+func upstreamError(pkt *rawPacket) error {
+	e, err := parseErrorResponse(pkt)
+	if err != nil {
+		return err
+	}
+	return &pgError{
+		severity: e.get('S'),
+		code:     e.get('C'),
+		err:      errors.New(e.get('M')),
+	}
+}
+
+func md5Password(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+func readAuthentication(up io.Reader) (*authentication, error) {
+	var pkt rawPacket
+	if err := pkt.read(up, noMessageSizeLimit); err != nil {
+		return nil, err
+	}
+	switch pkt.header {
+	case 'R':
+		return parseAuthentication(&pkt)
+	case 'E':
+		return nil, upstreamError(&pkt)
+	default:
+		return nil, fmt.Errorf("unexpected message during authentication: %q", pkt.header)
+	}
+}
+
+func writePasswordMessage(up io.Writer, msg *passwordMessage) error {
+	raw := msg.toRaw()
+	return raw.write(up)
+}
+
+// authenticateUpstream answers authentication requests from upstream until AuthenticationOk.
+func authenticateUpstream(up io.ReadWriter, user string, entry *Connection) error {
+	var password *string
+	getPassword := func() (string, error) {
+		if password == nil {
+			v, err := entry.password()
+			if err != nil {
+				return "", err
+			}
+			password = &v
+		}
+		return *password, nil
+	}
+
+	var scram *scramClient
+	for {
+		auth, err := readAuthentication(up)
+		if err != nil {
+			return err
+		}
+
+		switch auth.code {
+		case authenticationOk:
+			return nil
+
+		case authenticationCleartextPassword:
+			pw, err := getPassword()
+			if err != nil {
+				return err
+			}
+			if err := writePasswordMessage(up, newPasswordMessage(pw)); err != nil {
+				return err
+			}
+
+		case authenticationMD5Password:
+			if len(auth.data) != 4 {
+				return fmt.Errorf("invalid AuthenticationMD5Password")
+			}
+			pw, err := getPassword()
+			if err != nil {
+				return err
+			}
+			if err := writePasswordMessage(up, newPasswordMessage(md5Password(user, pw, auth.data))); err != nil {
+				return err
+			}
+
+		case authenticationSASL:
+			mechanisms, err := auth.mechanisms()
+			if err != nil {
+				return err
+			}
+			supported := false
+			for _, m := range mechanisms {
+				supported = supported || m == "SCRAM-SHA-256"
+			}
+			if !supported {
+				return fmt.Errorf("unsupported SASL mechanisms: %q", mechanisms)
+			}
+			pw, err := getPassword()
+			if err != nil {
+				return err
+			}
+			// postgres ignores the user name in SCRAM. like libpq.
+			scram = newScramClient("", pw)
+			if err := writePasswordMessage(up, newSASLInitialResponse("SCRAM-SHA-256", []byte(scram.first()))); err != nil {
+				return err
+			}
+
+		case authenticationSASLContinue:
+			if scram == nil {
+				return fmt.Errorf("unexpected AuthenticationSASLContinue")
+			}
+			final, err := scram.final(string(auth.data))
+			if err != nil {
+				return err
+			}
+			if err := writePasswordMessage(up, &passwordMessage{[]byte(final)}); err != nil {
+				return err
+			}
+
+		case authenticationSASLFinal:
+			if scram == nil {
+				return fmt.Errorf("unexpected AuthenticationSASLFinal")
+			}
+			if err := scram.verify(string(auth.data)); err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("unsupported authentication request: %d", auth.code)
+		}
+	}
+}
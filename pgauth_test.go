@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func writeTestPackets(w io.Writer, pkts ...rawPacket) error {
+	for _, pkt := range pkts {
+		if err := pkt.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func testAuthFailed(conn net.Conn) {
+	e := &errorResponse{
+		fields: []errorResponseField{
+			{'S', "FATAL"},
+			{'C', "28P01"},
+			{'M', "password authentication failed"},
+		},
+	}
+	writeTestPackets(conn, e.toRaw())
+}
+
+// testScramServer verifies SCRAM-SHA-256 exchange. returns false on failure.
+func testScramServer(conn net.Conn, password string) bool {
+	salt := []byte("0123456789abcdef")
+	salted := pbkdf2.Key([]byte(password), salt, 4096, sha256.Size, sha256.New)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	var pkt rawPacket
+	if err := pkt.read(conn, noMessageSizeLimit); err != nil || pkt.header != 'p' {
+		return false
+	}
+	b := bytes.NewBuffer(pkt.data)
+	if m, err := readString(b); err != nil || m != "SCRAM-SHA-256" {
+		return false
+	}
+	if _, err := read32(b); err != nil {
+		return false
+	}
+	clientFirstBare := strings.TrimPrefix(b.String(), "n,,")
+	i := strings.Index(clientFirstBare, "r=")
+	if i < 0 {
+		return false
+	}
+	nonce := clientFirstBare[i+2:] + "server"
+	serverFirst := "r=" + nonce + ",s=" + base64.StdEncoding.EncodeToString(salt) + ",i=4096"
+	if err := writeTestPackets(conn, (&authentication{authenticationSASLContinue, []byte(serverFirst)}).toRaw()); err != nil {
+		return false
+	}
+
+	if err := pkt.read(conn, noMessageSizeLimit); err != nil || pkt.header != 'p' {
+		return false
+	}
+	final := string(pkt.data)
+	j := strings.Index(final, ",p=")
+	if j < 0 {
+		return false
+	}
+	withoutProof := final[:j]
+	if withoutProof != "c=biws,r="+nonce {
+		return false
+	}
+	proof, err := base64.StdEncoding.DecodeString(final[j+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return false
+	}
+	authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+	signature := scramHMAC(storedKey[:], authMessage)
+	for k := range proof {
+		proof[k] ^= signature[k]
+	}
+	if sum := sha256.Sum256(proof); !hmac.Equal(sum[:], storedKey[:]) {
+		return false
+	}
+
+	serverFinal := "v=" + base64.StdEncoding.EncodeToString(scramHMAC(scramHMAC(salted, "Server Key"), authMessage))
+	return writeTestPackets(conn, (&authentication{authenticationSASLFinal, []byte(serverFinal)}).toRaw()) == nil
+}
+
+// handleTestPostgresAuth requires password by method.
+func handleTestPostgresAuth(method uint32, password string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		var initial rawInitialPacket
+		if err := initial.read(conn); err != nil {
+			return
+		}
+		p, err := initial.toConcrete()
+		if err != nil {
+			return
+		}
+		user := p.(*startupMessage).params["user"]
+
+		ok := false
+		switch method {
+		case authenticationCleartextPassword, authenticationMD5Password:
+			salt := []byte{1, 2, 3, 4}
+			req := &authentication{code: method}
+			if method == authenticationMD5Password {
+				req.data = salt
+			}
+			if err := writeTestPackets(conn, req.toRaw()); err != nil {
+				return
+			}
+			var pkt rawPacket
+			if err := pkt.read(conn, noMessageSizeLimit); err != nil {
+				return
+			}
+			got, err := readString(bytes.NewBuffer(pkt.data))
+			if err != nil {
+				return
+			}
+			wants := password
+			if method == authenticationMD5Password {
+				wants = md5Password(user, password, salt)
+			}
+			ok = got == wants
+		case authenticationSASL:
+			req := &authentication{authenticationSASL, []byte("SCRAM-SHA-256-PLUS\x00SCRAM-SHA-256\x00\x00")}
+			if err := writeTestPackets(conn, req.toRaw()); err != nil {
+				return
+			}
+			ok = testScramServer(conn, password)
+		}
+		if !ok {
+			testAuthFailed(conn)
+			return
+		}
+
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint32(key, 1)
+		writeTestPackets(conn,
+			(&authentication{code: authenticationOk}).toRaw(),
+			rawPacket{'S', []byte("server_version\x0015\x00")},
+			rawPacket{'K', key},
+			rawPacket{'Z', []byte{'I'}},
+		)
+		io.Copy(io.Discard, conn)
+	}
+}
+
+func TestServeInjectPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   uint32
+		entry    Connection
+		messages string
+		code     string
+	}{
+		{
+			name:     "cleartext",
+			method:   authenticationCleartextPassword,
+			entry:    Connection{Password: "secret"},
+			messages: "RSKZ",
+		},
+		{
+			name:     "md5",
+			method:   authenticationMD5Password,
+			entry:    Connection{Password: "secret"},
+			messages: "RSKZ",
+		},
+		{
+			name:     "scram",
+			method:   authenticationSASL,
+			entry:    Connection{Password: "secret"},
+			messages: "RSKZ",
+		},
+		{
+			name:     "command",
+			method:   authenticationSASL,
+			entry:    Connection{PasswordCommand: "echo secret"},
+			messages: "RSKZ",
+		},
+		{
+			name:     "wrong_password",
+			method:   authenticationMD5Password,
+			entry:    Connection{Password: "wrong"},
+			messages: "E",
+			code:     "28P01",
+		},
+		{
+			name:     "wrong_scram",
+			method:   authenticationSASL,
+			entry:    Connection{Password: "wrong"},
+			messages: "E",
+			code:     "28P01",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pg := startTestPostgres(t, handleTestPostgresAuth(test.method, "secret"))
+			entry := test.entry
+			entry.Addr = pg
+			entry.Dbname = "db"
+			s := newTestServer(startTestSshJumpServer(t), map[string]*Connection{
+				"db": &entry,
+			})
+
+			client := testServe(t, s)
+			startup := (&startupMessage{map[string]string{"database": "db", "user": "guest"}}).toRaw()
+			if err := startup.write(client); err != nil {
+				t.Fatal(err)
+			}
+
+			messages := ""
+			for !strings.HasSuffix(messages, "Z") && !strings.HasSuffix(messages, "E") {
+				var pkt rawPacket
+				if err := pkt.read(client, noMessageSizeLimit); err != nil {
+					t.Fatal(err)
+				}
+				messages += string(pkt.header)
+
+				switch pkt.header {
+				case 'R':
+					auth, err := parseAuthentication(&pkt)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if auth.code != authenticationOk {
+						t.Fatalf("challenge is exposed: %d", auth.code)
+					}
+				case 'E':
+					e, err := parseErrorResponse(&pkt)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if code := e.get('C'); code != test.code {
+						t.Fatalf("%s != %s", code, test.code)
+					}
+				}
+			}
+			if messages != test.messages {
+				t.Fatalf("%s != %s", messages, test.messages)
+			}
+		})
+	}
+}
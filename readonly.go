@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+type sqlToken struct {
+	// upper-cased keyword or identifier. quoted identifiers keep their quotes.
+	word string
+	// parenthesis depth.
+	depth int
+}
+
+func isSqlWordStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func isSqlWord(c byte) bool {
+	return isSqlWordStart(c) || c == '$' || c >= '0' && c <= '9'
+}
+
+// skipSqlString returns the index after the literal quoted by q beginning at i.
+func skipSqlString(s string, i int, q byte, backslash bool) int {
+	for i++; i < len(s); i++ {
+		switch {
+		case backslash && s[i] == '\\':
+			i++
+		case s[i] == q:
+			if i+1 < len(s) && s[i+1] == q {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(s)
+}
+
+// splitSqlStatements tokenizes query into statements. literals, comments and operators are dropped.
+func splitSqlStatements(query string) [][]sqlToken {
+	var r [][]sqlToken
+	var stmt []sqlToken
+	depth := 0
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ';' && depth == 0:
+			r = append(r, stmt)
+			stmt = nil
+			i++
+
+		case c == '(':
+			depth++
+			i++
+
+		case c == ')':
+			if depth > 0 {
+				depth--
+			}
+			i++
+
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			if n := strings.IndexByte(query[i:], '\n'); n >= 0 {
+				i += n + 1
+			} else {
+				i = len(query)
+			}
+
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			// block comments nest.
+			nest := 0
+			for i < len(query) {
+				if strings.HasPrefix(query[i:], "/*") {
+					nest++
+					i += 2
+				} else if strings.HasPrefix(query[i:], "*/") {
+					nest--
+					i += 2
+					if nest == 0 {
+						break
+					}
+				} else {
+					i++
+				}
+			}
+
+		case c == '\'':
+			i = skipSqlString(query, i, '\'', false)
+
+		case c == '"':
+			end := skipSqlString(query, i, '"', false)
+			stmt = append(stmt, sqlToken{query[i:end], depth})
+			i = end
+
+		case c == '$':
+			// $tag$...$tag$. $1 is a parameter.
+			j := i + 1
+			for j < len(query) && isSqlWord(query[j]) && query[j] != '$' {
+				j++
+			}
+			if j < len(query) && query[j] == '$' && (j == i+1 || isSqlWordStart(query[i+1])) {
+				tag := query[i : j+1]
+				if n := strings.Index(query[j+1:], tag); n >= 0 {
+					i = j + 1 + n + len(tag)
+				} else {
+					i = len(query)
+				}
+				continue
+			}
+			i = j
+
+		case isSqlWordStart(c):
+			j := i
+			for j < len(query) && isSqlWord(query[j]) {
+				j++
+			}
+			word := strings.ToUpper(query[i:j])
+			if j < len(query) && query[j] == '\'' {
+				// E'...' accepts backslash escapes. B'', X'' and N'' are plain.
+				i = skipSqlString(query, j, '\'', word == "E")
+				continue
+			}
+			stmt = append(stmt, sqlToken{word, depth})
+			i = j
+
+		default:
+			i++
+		}
+	}
+	return append(r, stmt)
+}
+
+func hasSqlWord(stmt []sqlToken, maxDepth int, words ...string) bool {
+	for _, t := range stmt {
+		if t.depth > maxDepth {
+			continue
+		}
+		for _, w := range words {
+			if t.word == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasSqlName is hasSqlWord ignoring quotes and case. for names of parameters and functions.
+func hasSqlName(stmt []sqlToken, maxDepth int, names ...string) bool {
+	for _, t := range stmt {
+		if t.depth > maxDepth {
+			continue
+		}
+		word := strings.ToUpper(strings.Trim(t.word, `"`))
+		for _, n := range names {
+			if word == n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sqlWordAfter returns tokens following the first top-level word.
+func sqlWordAfter(stmt []sqlToken, word string) []sqlToken {
+	for i, t := range stmt {
+		if t.depth == 0 && t.word == word {
+			return stmt[i+1:]
+		}
+	}
+	return nil
+}
+
+const anyDepth = 1 << 30
+
+// hasRowLock reports whether stmt has FOR UPDATE, FOR NO KEY UPDATE, FOR SHARE or FOR KEY SHARE.
+func hasRowLock(stmt []sqlToken) bool {
+	for i, t := range stmt[:len(stmt)-1] {
+		if t.word != "FOR" {
+			continue
+		}
+		switch stmt[i+1].word {
+		case "UPDATE", "SHARE", "NO", "KEY":
+			return true
+		}
+	}
+	return false
+}
+
+// parenthesized returns tokens in the parentheses just after stmt[0]. depths are decremented.
+func parenthesized(stmt []sqlToken) []sqlToken {
+	var r []sqlToken
+	for _, t := range stmt[1:] {
+		if t.depth == 0 {
+			break
+		}
+		r = append(r, sqlToken{t.word, t.depth - 1})
+	}
+	return r
+}
+
+// readOnlyStatement reports whether stmt can not write.
+// functions with side effects called from SELECT are not detected.
+// literals are split assuming standard_conforming_strings is on. changing it is rejected.
+func readOnlyStatement(stmt []sqlToken) bool {
+	if len(stmt) == 0 {
+		return true
+	}
+	// set_config('standard_conforming_strings', ...) is not visible since literals are dropped.
+	if hasSqlName(stmt, anyDepth, "SET_CONFIG") {
+		return false
+	}
+
+	switch stmt[0].word {
+	case "SELECT", "VALUES", "TABLE":
+		return !hasSqlWord(stmt, 0, "INTO") && !hasRowLock(stmt)
+	case "WITH":
+		return !hasSqlWord(stmt, 0, "INTO") && !hasSqlWord(stmt, anyDepth, "INSERT", "UPDATE", "DELETE", "MERGE") && !hasRowLock(stmt)
+	case "SHOW", "FETCH", "MOVE", "CLOSE", "COMMIT", "END", "ROLLBACK", "ABORT", "SAVEPOINT", "RELEASE", "DEALLOCATE", "DISCARD", "LISTEN", "UNLISTEN", "EXECUTE":
+		return true
+	case "BEGIN", "START":
+		return !hasSqlWord(stmt, 0, "WRITE")
+	case "SET", "RESET":
+		return !hasSqlWord(stmt, 0, "WRITE") && !hasSqlName(stmt, 0, "TRANSACTION_READ_ONLY", "DEFAULT_TRANSACTION_READ_ONLY", "STANDARD_CONFORMING_STRINGS", "ESCAPE_STRING_WARNING")
+	case "EXPLAIN":
+		// without ANALYZE the statement is not executed.
+		if !hasSqlWord(stmt, 1, "ANALYZE", "ANALYSE") {
+			return true
+		}
+		for i, t := range stmt[1:] {
+			switch t.word {
+			case "SELECT", "VALUES", "TABLE", "WITH", "EXECUTE", "DECLARE", "INSERT", "UPDATE", "DELETE", "MERGE", "CREATE":
+				if t.depth == 0 {
+					return readOnlyStatement(stmt[i+1:])
+				}
+			}
+		}
+		return false
+	case "PREPARE":
+		inner := sqlWordAfter(stmt, "AS")
+		return len(inner) > 0 && readOnlyStatement(inner)
+	case "DECLARE":
+		inner := sqlWordAfter(stmt, "FOR")
+		return len(inner) > 0 && readOnlyStatement(inner)
+	case "COPY":
+		// COPY (query) TO runs the query.
+		return !hasSqlWord(stmt, 0, "FROM", "PROGRAM") && readOnlyStatement(parenthesized(stmt))
+	}
+	return false
+}
+
+// readOnlyStartup pins standard_conforming_strings to on, which splitSqlStatements assumes.
+// params are the ones after `params` of the entry, whose `set` are given, are applied.
+// options not set by the entry are rejected since they may change anything.
+func readOnlyStartup(params, set map[string]string) error {
+	forbidden := func(k string) error {
+		return &pgError{
+			severity: "FATAL",
+			code:     "42501",
+			err:      fmt.Errorf("parameter %q is not allowed in a read-only connection", k),
+		}
+	}
+	if options, exists := params["options"]; exists {
+		if set["options"] != options {
+			return forbidden("options")
+		}
+		for _, n := range startupOptionNames(options) {
+			if n == "standard_conforming_strings" {
+				return forbidden(n)
+			}
+		}
+	}
+	for k, v := range params {
+		if startupParamName(k) != "standard_conforming_strings" {
+			continue
+		}
+		if strings.ToLower(v) != "on" {
+			return forbidden(k)
+		}
+		delete(params, k)
+	}
+	params["standard_conforming_strings"] = "on"
+	return nil
+}
+
+func readOnlyViolation(query string) error {
+	for _, stmt := range splitSqlStatements(query) {
+		if !readOnlyStatement(stmt) {
+			return &pgError{
+				severity: "ERROR",
+				code:     "25006",
+				err:      fmt.Errorf("cannot execute %s in a read-only connection", stmt[0].word),
+			}
+		}
+	}
+	return nil
+}
+
+// readOnlyGuard relays messages rejecting statements which may write.
+// rejected Query or Parse is replaced by Sync to upstream. the error is sent to the client
+// just before ReadyForQuery for it, so the order of responses is kept.
+type readOnlyGuard struct {
+	mu sync.Mutex
+	// error to be sent before each expected ReadyForQuery. nil for none.
+	pending []*errorResponse
+}
+
+func (g *readOnlyGuard) push(e *errorResponse) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.pending = append(g.pending, e)
+}
+
+func (g *readOnlyGuard) pop() *errorResponse {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.pending) == 0 {
+		return nil
+	}
+	e := g.pending[0]
+	g.pending = g.pending[1:]
+	return e
+}
+
+// frontend handles frontend messages.
+func (g *readOnlyGuard) frontend(next messageHandler) messageHandler {
+	// set after rejected Parse. messages are discarded until Sync like postgres does.
+	var discarding *errorResponse
+	syncMsg := rawPacket{header: 'S'}
+
+	return func(w io.Writer, pkt *rawPacket) error {
+		if discarding != nil {
+			switch pkt.header {
+			case 'S':
+				g.push(discarding)
+				discarding = nil
+			case 'X':
+			default:
+				return nil
+			}
+			return next(w, pkt)
+		}
+
+		switch pkt.header {
+		case 'Q':
+			query, err := readString(bytes.NewBuffer(pkt.data))
+			if err != nil {
+				return err
+			}
+			if err := readOnlyViolation(query); err != nil {
+				g.push(newErrorResponse(err))
+				return next(w, &syncMsg)
+			}
+			g.push(nil)
+
+		case 'P':
+			b := bytes.NewBuffer(pkt.data)
+			if _, err := readString(b); err != nil {
+				return err
+			}
+			query, err := readString(b)
+			if err != nil {
+				return err
+			}
+			if err := readOnlyViolation(query); err != nil {
+				discarding = newErrorResponse(err)
+				return nil
+			}
+
+		case 'F':
+			// FunctionCall may call anything.
+			g.push(newErrorResponse(&pgError{
+				severity: "ERROR",
+				code:     "25006",
+				err:      fmt.Errorf("cannot execute function call in a read-only connection"),
+			}))
+			return next(w, &syncMsg)
+
+		case 'S':
+			g.push(nil)
+		}
+		return next(w, pkt)
+	}
+}
+
+// backend handles backend messages after the startup.
+func (g *readOnlyGuard) backend(next messageHandler) messageHandler {
+	return func(w io.Writer, pkt *rawPacket) error {
+		if pkt.header == 'Z' {
+			if e := g.pop(); e != nil {
+				raw := e.toRaw()
+				if err := next(w, &raw); err != nil {
+					return err
+				}
+			}
+		}
+		return next(w, pkt)
+	}
+}
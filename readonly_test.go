@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestReadOnlyViolation(t *testing.T) {
+	tests := []struct {
+		query    string
+		readOnly bool
+	}{
+		{"SELECT 1", true},
+		{"select * from t where name = 'delete'", true},
+		{"SELECT $$; DROP TABLE t; $$", true},
+		{"SELECT $tag$ ' $tag$, E'\\'; DELETE'", true},
+		{"SELECT 1 -- ; DELETE FROM t", true},
+		{"SELECT /* /* ; */ DELETE */ 1", true},
+		{"SELECT \"into\" FROM t", true},
+		{"SELECT $1", true},
+		{"", true},
+		{";;", true},
+		{"SHOW search_path", true},
+		{"VALUES (1)", true},
+		{"TABLE t", true},
+		{"WITH x AS (SELECT 1) SELECT * FROM x", true},
+		{"EXPLAIN DELETE FROM t", true},
+		{"EXPLAIN (ANALYZE, BUFFERS) SELECT 1", true},
+		{"BEGIN READ ONLY", true},
+		{"BEGIN; SELECT 1; COMMIT", true},
+		{"SET search_path = public", true},
+		{"PREPARE q (int) AS SELECT $1", true},
+		{"DECLARE c CURSOR WITH HOLD FOR SELECT 1", true},
+		{"COPY (SELECT a FROM t) TO STDOUT", true},
+		{"COPY t TO STDOUT", true},
+		{"COPY t (a, b) TO STDOUT", true},
+		{"SELECT * FROM t ORDER BY a FOR READ ONLY", true},
+		{"SELECT substring(a FROM 1 FOR 2) FROM t", true},
+		{"SET escape_string_warning_x = on", true},
+		// standard_conforming_strings is pinned to on. the string ends at the backslash.
+		{"SELECT 'x\\' ; ' ; DELETE FROM t; --", true},
+		{"SELECT 'x\\'' ; DELETE FROM t; --'", true},
+
+		{"INSERT INTO t VALUES (1)", false},
+		{"SELECT 1; DELETE FROM t", false},
+		{"SELECT * INTO t2 FROM t", false},
+		{"WITH x AS (DELETE FROM t RETURNING *) SELECT * FROM x", false},
+		{"EXPLAIN ANALYZE DELETE FROM t", false},
+		{"EXPLAIN (ANALYZE) UPDATE t SET a = 1", false},
+		{"BEGIN READ WRITE", false},
+		{"START TRANSACTION READ WRITE", false},
+		{"SET default_transaction_read_only = off", false},
+		{"SET SESSION CHARACTERISTICS AS TRANSACTION READ WRITE", false},
+		{"RESET transaction_read_only", false},
+		{"PREPARE q AS DELETE FROM t", false},
+		{"COPY t FROM STDIN", false},
+		{"COPY t TO PROGRAM 'sh'", false},
+		{"COPY (DELETE FROM t RETURNING 1) TO STDOUT", false},
+		{"COPY (WITH x AS (UPDATE t SET a = 1 RETURNING a) SELECT * FROM x) TO STDOUT", false},
+		{"COPY (SELECT * FROM t FOR UPDATE) TO STDOUT", false},
+		{"SELECT * FROM t FOR UPDATE", false},
+		{"SELECT * FROM t FOR NO KEY UPDATE NOWAIT", false},
+		{"select * from t for share", false},
+		{"SELECT * FROM t FOR KEY SHARE SKIP LOCKED", false},
+		{"SELECT * FROM (SELECT * FROM t FOR UPDATE) x", false},
+		{"WITH x AS (SELECT * FROM t FOR UPDATE) SELECT * FROM x", false},
+		{"DECLARE c CURSOR FOR SELECT * FROM t FOR UPDATE", false},
+		{"SET standard_conforming_strings = off", false},
+		{"SET LOCAL standard_conforming_strings TO off", false},
+		{"SET \"Standard_Conforming_Strings\" = off", false},
+		{"RESET standard_conforming_strings", false},
+		{"SET escape_string_warning = off", false},
+		{"SELECT set_config('standard_conforming_strings', 'off', false)", false},
+		{"SELECT pg_catalog.\"set_config\"('standard_conforming_strings', 'off', false)", false},
+		{"CREATE TABLE t (a int)", false},
+		{"DO $$ BEGIN END $$", false},
+		{"CALL p()", false},
+		{"  truncate t", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			err := readOnlyViolation(test.query)
+			if test.readOnly {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var pgErr *pgError
+			if !errors.As(err, &pgErr) || pgErr.code != "25006" {
+				t.Fatalf("%v != 25006", err)
+			}
+		})
+	}
+}
+
+func TestReadOnlyStartup(t *testing.T) {
+	tests := []struct {
+		name  string
+		input map[string]string
+		set   map[string]string
+		wants map[string]string
+	}{
+		{
+			name:  "pinned",
+			input: map[string]string{"user": "alice"},
+			wants: map[string]string{"user": "alice", "standard_conforming_strings": "on"},
+		},
+		{
+			name:  "on",
+			input: map[string]string{"user": "alice", "standard_conforming_strings": "ON"},
+			wants: map[string]string{"user": "alice", "standard_conforming_strings": "on"},
+		},
+		{
+			name:  "case",
+			input: map[string]string{"user": "alice", "Standard_Conforming_Strings": "on"},
+			wants: map[string]string{"user": "alice", "standard_conforming_strings": "on"},
+		},
+		{
+			name:  "case_off",
+			input: map[string]string{"user": "alice", "STANDARD_CONFORMING_STRINGS": "off"},
+		},
+		{
+			name:  "off",
+			input: map[string]string{"user": "alice", "standard_conforming_strings": "off"},
+		},
+		{
+			name:  "options",
+			input: map[string]string{"user": "alice", "options": "-c standard_conforming_strings=off"},
+		},
+		{
+			name:  "options_dash",
+			input: map[string]string{"user": "alice", "options": "-c standard-conforming-strings=off"},
+		},
+		{
+			name:  "options_long",
+			input: map[string]string{"user": "alice", "options": "--standard-conforming-strings=off"},
+		},
+		{
+			name:  "options_not_set",
+			input: map[string]string{"user": "alice", "options": "-c search_path=public"},
+		},
+		{
+			name:  "options_set",
+			input: map[string]string{"user": "alice", "options": "-c default_transaction_read_only=on"},
+			set:   map[string]string{"options": "-c default_transaction_read_only=on"},
+			wants: map[string]string{"user": "alice", "options": "-c default_transaction_read_only=on", "standard_conforming_strings": "on"},
+		},
+		{
+			name:  "options_set_dash",
+			input: map[string]string{"user": "alice", "options": "--standard-conforming-strings=off"},
+			set:   map[string]string{"options": "--standard-conforming-strings=off"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := readOnlyStartup(test.input, test.set)
+			if test.wants == nil {
+				var pgErr *pgError
+				if !errors.As(err, &pgErr) || pgErr.code != "42501" {
+					t.Fatalf("%v != 42501", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(test.input, test.wants) {
+				t.Fatalf("%v != %v", test.input, test.wants)
+			}
+		})
+	}
+}
+
+func newTestQuery(query string) rawPacket {
+	b := &bytes.Buffer{}
+	must(writeString(b, query))
+	return rawPacket{'Q', b.Bytes()}
+}
+
+func newTestParse(query string) rawPacket {
+	b := &bytes.Buffer{}
+	must(writeString(b, ""))
+	must(writeString(b, query))
+	b.Write([]byte{0, 0})
+	return rawPacket{'P', b.Bytes()}
+}
+
+func testReadPackets(t *testing.T, b *bytes.Buffer) string {
+	headers := ""
+	for b.Len() > 0 {
+		var pkt rawPacket
+		if err := pkt.read(b, noMessageSizeLimit); err != nil {
+			t.Fatal(err)
+		}
+		headers += string(pkt.header)
+	}
+	return headers
+}
+
+func TestReadOnlyGuard(t *testing.T) {
+	tests := []struct {
+		name     string
+		frontend []rawPacket
+		// messages reach upstream.
+		toUp string
+		// responses from upstream.
+		backend  string
+		toClient string
+	}{
+		{
+			name: "query",
+			frontend: []rawPacket{
+				newTestQuery("SELECT 1"),
+			},
+			toUp:     "Q",
+			backend:  "TDCZ",
+			toClient: "TDCZ",
+		},
+		{
+			name: "query_rejected",
+			frontend: []rawPacket{
+				newTestQuery("SELECT 1"),
+				newTestQuery("DELETE FROM t"),
+				newTestQuery("SELECT 2"),
+			},
+			toUp:     "QSQ",
+			backend:  "TDCZZTDCZ",
+			toClient: "TDCZEZTDCZ",
+		},
+		{
+			name: "parse_rejected",
+			frontend: []rawPacket{
+				newTestParse("SELECT 1"),
+				{'S', nil},
+				newTestParse("UPDATE t SET a = 1"),
+				{'B', []byte{0, 0, 0, 0, 0, 0, 0}},
+				{'E', []byte{0, 0, 0, 0, 0}},
+				{'S', nil},
+			},
+			toUp:     "PSS",
+			backend:  "1ZZ",
+			toClient: "1ZEZ",
+		},
+		{
+			name: "function_call",
+			frontend: []rawPacket{
+				{'F', []byte{0, 0, 0, 1}},
+			},
+			toUp:     "S",
+			backend:  "Z",
+			toClient: "EZ",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			guard := &readOnlyGuard{}
+
+			frontend := &bytes.Buffer{}
+			if err := writeTestPackets(frontend, test.frontend...); err != nil {
+				t.Fatal(err)
+			}
+			up := &bytes.Buffer{}
+			if err := messageRelay(maxFrontendMessageSize, guard.frontend(writeMessage))(up, frontend); err != nil {
+				t.Fatal(err)
+			}
+			if actual := testReadPackets(t, up); actual != test.toUp {
+				t.Fatalf("%s != %s", actual, test.toUp)
+			}
+
+			backend := &bytes.Buffer{}
+			for _, h := range []byte(test.backend) {
+				if err := writeTestPackets(backend, rawPacket{h, nil}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			client := &bytes.Buffer{}
+			if err := messageRelay(noMessageSizeLimit, guard.backend(writeMessage))(client, backend); err != nil {
+				t.Fatal(err)
+			}
+			if actual := testReadPackets(t, client); actual != test.toClient {
+				t.Fatalf("%s != %s", actual, test.toClient)
+			}
+			if len(guard.pending) != 0 {
+				t.Fatal(guard.pending)
+			}
+		})
+	}
+}
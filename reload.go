@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+func (s *server) currentConfig() *config {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.config
+}
+
+// dedicatedListener is a listener of an entry with `listen`.
+type dedicatedListener struct {
+	addr string
+	l    net.Listener
+}
+
+// bindDedicated returns listeners for `listen` of next. current ones with the same address are reused.
+// opened ones are closed if any fails.
+func (s *server) bindDedicated(next *config) (map[string]dedicatedListener, error) {
+	r := map[string]dedicatedListener{}
+	for _, name := range next.dedicated() {
+		addr := next.Connections[name].Listen
+		if d, exists := s.dedicated[name]; exists && d.addr == addr {
+			r[name] = d
+			continue
+		}
+
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			for n, d := range r {
+				if s.dedicated[n] != d {
+					d.l.Close()
+				}
+			}
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		r[name] = dedicatedListener{addr, l}
+	}
+	return r, nil
+}
+
+// reload swaps the config for new sessions. running sessions keep their tunnels.
+// ssh clients not used by next are retired. listeners of entries with `listen` are
+// started or closed. cx is passed to sessions on new listeners.
+// fails without swapping if any `listen` can not be bound.
+func (s *server) reload(cx context.Context, next *config) error {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	if s.closed {
+		return fmt.Errorf("shutting down")
+	}
+
+	listeners, err := s.bindDedicated(next)
+	if err != nil {
+		return err
+	}
+
+	s.configMu.Lock()
+	s.config = next
+	s.configMu.Unlock()
+
+	keep := map[string]bool{}
+	for _, entry := range next.Connections {
+		c := newSshTunnelSshConfig(next.fs, &entry.Ssh)
+		keep[c.key()] = true
+	}
+	s.pool.retire(keep)
+
+	for name, d := range s.dedicated {
+		if listeners[name] != d {
+			d.l.Close()
+		}
+	}
+	for name, d := range listeners {
+		if s.dedicated[name] != d {
+			s.accepting.Add(1)
+			go func(l net.Listener, name string) {
+				defer s.accepting.Done()
+				s.accept(cx, l, name)
+			}(d.l, name)
+		}
+	}
+	s.dedicated = listeners
+	return nil
+}
+
+// closeDedicated closes listeners of entries with `listen` and waits their accept loops.
+// later reloads fail.
+func (s *server) closeDedicated() {
+	s.listenersMu.Lock()
+	s.closed = true
+	for _, d := range s.dedicated {
+		d.l.Close()
+	}
+	s.dedicated = nil
+	s.listenersMu.Unlock()
+
+	s.accepting.Wait()
+}
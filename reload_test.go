@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestServerReload(t *testing.T) {
+	pg := startTestPostgres(t, handleTestPostgresReady)
+	srv := startTestSshJumpServer(t)
+	s := newTestServer(srv, map[string]*Connection{
+		"db": {
+			Addr:   pg,
+			Dbname: "db",
+		},
+	})
+
+	startup := func(database string) byte {
+		client := testServe(t, s)
+		raw := (&startupMessage{map[string]string{"database": database, "user": "guest"}}).toRaw()
+		if err := raw.write(client); err != nil {
+			t.Fatal(err)
+		}
+		var pkt rawPacket
+		if err := pkt.read(client, noMessageSizeLimit); err != nil {
+			t.Fatal(err)
+		}
+		return pkt.header
+	}
+	if h := startup("db"); h != 'R' {
+		t.Fatalf("%c != R", h)
+	}
+
+	next := newTestServer(srv, map[string]*Connection{
+		"db2": {
+			Addr:   pg,
+			Dbname: "db2",
+		},
+	}).config
+	if err := s.reload(context.Background(), next); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.currentConfig() != next {
+		t.Fatal("not swapped.")
+	}
+	if h := startup("db"); h != 'E' {
+		t.Fatalf("%c != E", h)
+	}
+	if h := startup("db2"); h != 'R' {
+		t.Fatalf("%c != R", h)
+	}
+}
+
+// testStartupAt sends StartupMessage to addr and returns the header of the answer.
+func testStartupAt(t *testing.T, addr string) byte {
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	raw := (&startupMessage{map[string]string{"database": "any", "user": "guest"}}).toRaw()
+	if err := raw.write(client); err != nil {
+		t.Fatal(err)
+	}
+	var pkt rawPacket
+	if err := pkt.read(client, noMessageSizeLimit); err != nil {
+		t.Fatal(err)
+	}
+	return pkt.header
+}
+
+func TestServerReloadListen(t *testing.T) {
+	pg := startTestPostgres(t, handleTestPostgresReady)
+	srv := startTestSshJumpServer(t)
+	s := newTestServer(srv, map[string]*Connection{
+		"db": {Addr: pg, Dbname: "db", Listen: "[::1]:0"},
+	})
+	t.Cleanup(s.closeDedicated)
+	if err := s.reload(context.Background(), s.currentConfig()); err != nil {
+		t.Fatal(err)
+	}
+	db := s.dedicated["db"]
+	if h := testStartupAt(t, db.l.Addr().String()); h != 'R' {
+		t.Fatalf("%c != R", h)
+	}
+
+	// added.
+	next := newTestServer(srv, map[string]*Connection{
+		"db":  {Addr: pg, Dbname: "db", Listen: "[::1]:0"},
+		"db2": {Addr: pg, Dbname: "db2", Listen: "[::1]:0"},
+	}).config
+	if err := s.reload(context.Background(), next); err != nil {
+		t.Fatal(err)
+	}
+	if s.dedicated["db"] != db {
+		t.Fatal("db is rebound.")
+	}
+	db2 := s.dedicated["db2"]
+	for _, d := range []dedicatedListener{db, db2} {
+		if h := testStartupAt(t, d.l.Addr().String()); h != 'R' {
+			t.Fatalf("%c != R", h)
+		}
+	}
+
+	// removed.
+	next = newTestServer(srv, map[string]*Connection{
+		"db":  {Addr: pg, Dbname: "db"},
+		"db2": {Addr: pg, Dbname: "db2", Listen: "[::1]:0"},
+	}).config
+	if err := s.reload(context.Background(), next); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := s.dedicated["db"]; exists {
+		t.Fatal("db is not removed.")
+	}
+	if _, err := net.Dial("tcp", db.l.Addr().String()); err == nil {
+		t.Fatal("db is still listening.")
+	}
+	if h := testStartupAt(t, db2.l.Addr().String()); h != 'R' {
+		t.Fatalf("%c != R", h)
+	}
+
+	// can not be bound.
+	used, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer used.Close()
+	prev := s.currentConfig()
+	next = newTestServer(srv, map[string]*Connection{
+		"db":  {Addr: pg, Dbname: "db", Listen: "[::1]:0"},
+		"db2": {Addr: pg, Dbname: "db2", Listen: used.Addr().String()},
+	}).config
+	if err := s.reload(context.Background(), next); err == nil {
+		t.Fatal("no error occurred")
+	}
+	if s.currentConfig() != prev {
+		t.Fatal("swapped.")
+	}
+	if len(s.dedicated) != 1 || s.dedicated["db2"] != db2 {
+		t.Fatalf("%v", s.dedicated)
+	}
+	if h := testStartupAt(t, db2.l.Addr().String()); h != 'R' {
+		t.Fatalf("%c != R", h)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// scramClient is client side of SCRAM-SHA-256 (RFC 7677) without channel binding.
+type scramClient struct {
+	user     string
+	password string
+	nonce    string
+
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func newScramClient(user, password string) *scramClient {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return &scramClient{
+		user:     user,
+		password: password,
+		nonce:    base64.StdEncoding.EncodeToString(b),
+	}
+}
+
+func scramHMAC(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+// first returns client-first-message.
+func (c *scramClient) first() string {
+	c.clientFirstBare = fmt.Sprintf("n=%s,r=%s", c.user, c.nonce)
+	return "n,," + c.clientFirstBare
+}
+
+// final returns client-final-message for server-first-message.
+func (c *scramClient) final(serverFirst string) (string, error) {
+	var nonce, salt string
+	var iter int
+	for _, attr := range strings.Split(serverFirst, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			return "", fmt.Errorf("scram: invalid server-first-message")
+		}
+		switch attr[0] {
+		case 'r':
+			nonce = attr[2:]
+		case 's':
+			salt = attr[2:]
+		case 'i':
+			v, err := strconv.Atoi(attr[2:])
+			if err != nil {
+				return "", fmt.Errorf("scram: invalid iteration count: %w", err)
+			}
+			iter = v
+		}
+	}
+	if !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+		return "", fmt.Errorf("scram: invalid server nonce")
+	}
+	if iter <= 0 {
+		return "", fmt.Errorf("scram: invalid iteration count")
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return "", fmt.Errorf("scram: invalid salt: %w", err)
+	}
+
+	salted := pbkdf2.Key([]byte(c.password), saltBytes, iter, sha256.Size, sha256.New)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := c.clientFirstBare + "," + serverFirst + "," + withoutProof
+
+	signature := scramHMAC(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	c.serverSignature = scramHMAC(scramHMAC(salted, "Server Key"), authMessage)
+
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verify checks server-final-message.
+func (c *scramClient) verify(serverFinal string) error {
+	if strings.HasPrefix(serverFinal, "e=") {
+		return fmt.Errorf("scram: %s", serverFinal[2:])
+	}
+	if !strings.HasPrefix(serverFinal, "v=") {
+		return fmt.Errorf("scram: invalid server-final-message")
+	}
+	v, err := base64.StdEncoding.DecodeString(serverFinal[2:])
+	if err != nil {
+		return fmt.Errorf("scram: invalid server signature: %w", err)
+	}
+	if c.serverSignature == nil || !hmac.Equal(v, c.serverSignature) {
+		return fmt.Errorf("scram: server signature mismatch")
+	}
+	return nil
+}
+
+// scramSecret is the verifier of SCRAM-SHA-256 like pg_authid.rolpassword.
+type scramSecret struct {
+	iter      int
+	salt      []byte
+	storedKey []byte
+	serverKey []byte
+}
+
+func newScramSecret(password string, salt []byte, iter int) *scramSecret {
+	salted := pbkdf2.Key([]byte(password), salt, iter, sha256.Size, sha256.New)
+	storedKey := sha256.Sum256(scramHMAC(salted, "Client Key"))
+	return &scramSecret{
+		iter:      iter,
+		salt:      salt,
+		storedKey: storedKey[:],
+		serverKey: scramHMAC(salted, "Server Key"),
+	}
+}
+
+// parseScramSecret parses `SCRAM-SHA-256$<iter>:<salt>$<StoredKey>:<ServerKey>`.
+func parseScramSecret(v string) (*scramSecret, error) {
+	invalid := fmt.Errorf("invalid SCRAM-SHA-256 secret")
+
+	parts := strings.Split(v, "$")
+	if len(parts) != 3 || parts[0] != "SCRAM-SHA-256" {
+		return nil, invalid
+	}
+	iterSalt := strings.SplitN(parts[1], ":", 2)
+	keys := strings.SplitN(parts[2], ":", 2)
+	if len(iterSalt) != 2 || len(keys) != 2 {
+		return nil, invalid
+	}
+
+	iter, err := strconv.Atoi(iterSalt[0])
+	if err != nil || iter <= 0 {
+		return nil, invalid
+	}
+	r := &scramSecret{iter: iter}
+	for _, v := range []struct {
+		dst *[]byte
+		src string
+	}{
+		{&r.salt, iterSalt[1]},
+		{&r.storedKey, keys[0]},
+		{&r.serverKey, keys[1]},
+	} {
+		b, err := base64.StdEncoding.DecodeString(v.src)
+		if err != nil {
+			return nil, invalid
+		}
+		*v.dst = b
+	}
+	return r, nil
+}
+
+// scramServer is server side of SCRAM-SHA-256 without channel binding.
+type scramServer struct {
+	secret *scramSecret
+	nonce  string
+
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+}
+
+func newScramServer(secret *scramSecret) *scramServer {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return &scramServer{
+		secret: secret,
+		nonce:  base64.StdEncoding.EncodeToString(b),
+	}
+}
+
+// first returns server-first-message for client-first-message.
+func (s *scramServer) first(clientFirst string) (string, error) {
+	// gs2-header is `n,,` or `y,,`. channel binding `p=` is not supported.
+	parts := strings.SplitN(clientFirst, ",", 3)
+	if len(parts) != 3 || (parts[0] != "n" && parts[0] != "y") || parts[1] != "" {
+		return "", fmt.Errorf("scram: unsupported client-first-message")
+	}
+	s.gs2Header = parts[0] + ",,"
+	s.clientFirstBare = parts[2]
+
+	var nonce string
+	for _, attr := range strings.Split(s.clientFirstBare, ",") {
+		if strings.HasPrefix(attr, "r=") {
+			nonce = attr[2:]
+		}
+	}
+	if nonce == "" {
+		return "", fmt.Errorf("scram: no client nonce")
+	}
+	s.nonce = nonce + s.nonce
+
+	s.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", s.nonce, base64.StdEncoding.EncodeToString(s.secret.salt), s.secret.iter)
+	return s.serverFirst, nil
+}
+
+// final verifies client-final-message and returns server-final-message.
+func (s *scramServer) final(clientFinal string) (string, error) {
+	i := strings.LastIndex(clientFinal, ",p=")
+	if i < 0 {
+		return "", fmt.Errorf("scram: no client proof")
+	}
+	withoutProof := clientFinal[:i]
+	if withoutProof != "c="+base64.StdEncoding.EncodeToString([]byte(s.gs2Header))+",r="+s.nonce {
+		return "", fmt.Errorf("scram: invalid client-final-message")
+	}
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[i+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return "", fmt.Errorf("scram: invalid client proof")
+	}
+
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + withoutProof
+	signature := scramHMAC(s.secret.storedKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ signature[i]
+	}
+	if sum := sha256.Sum256(clientKey); !hmac.Equal(sum[:], s.secret.storedKey) {
+		return "", fmt.Errorf("scram: client proof mismatch")
+	}
+
+	return "v=" + base64.StdEncoding.EncodeToString(scramHMAC(s.secret.serverKey, authMessage)), nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// RFC 7677 section 3.
+func TestScramClient(t *testing.T) {
+	c := &scramClient{
+		user:     "user",
+		password: "pencil",
+		nonce:    "rOprNGfwEbeRWgbNEkqO",
+	}
+	if v := c.first(); v != "n,,n=user,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Fatal(v)
+	}
+
+	final, err := c.final("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wants := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="; final != wants {
+		t.Fatalf("%s != %s", final, wants)
+	}
+
+	if err := c.verify("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.verify("v=AAAA"); err == nil {
+		t.Fatal("no error occurred.")
+	}
+}
+
+func TestScramClientInvalidServerFirst(t *testing.T) {
+	tests := []struct {
+		name        string
+		serverFirst string
+		err         string
+	}{
+		{
+			name:        "nonce_mismatch",
+			serverFirst: "r=other,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			err:         "scram: invalid server nonce",
+		},
+		{
+			name:        "no_server_nonce",
+			serverFirst: "r=rOprNGfwEbeRWgbNEkqO,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			err:         "scram: invalid server nonce",
+		},
+		{
+			name:        "no_iteration",
+			serverFirst: "r=rOprNGfwEbeRWgbNEkqOxxx,s=W22ZaJ0SNY7soEsUEjb6gQ==",
+			err:         "scram: invalid iteration count",
+		},
+		{
+			name:        "invalid",
+			serverFirst: "garbage",
+			err:         "scram: invalid server-first-message",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &scramClient{
+				user:     "user",
+				password: "pencil",
+				nonce:    "rOprNGfwEbeRWgbNEkqO",
+			}
+			c.first()
+			_, err := c.final(test.serverFirst)
+			if err == nil {
+				t.Fatal("no error occurred.")
+			}
+			if err.Error() != test.err {
+				t.Fatalf("%s != %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestScramServer(t *testing.T) {
+	secret, err := parseScramSecret("SCRAM-SHA-256$4096:W22ZaJ0SNY7soEsUEjb6gQ==$WG5d8oPm3OtcPnkdi4Uo7BkeZkBFzpcXkuLmtbsT4qY=:wfPLwcE6nTWhTAmQ7tl2KeoiWGPlZqQxSrmfPwDl2dU=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(secret, newScramSecret("pencil", secret.salt, 4096)) {
+		t.Fatal("secret does not match with password")
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		err      string
+	}{
+		{
+			name:     "ok",
+			password: "pencil",
+		},
+		{
+			name:     "wrong_password",
+			password: "eraser",
+			err:      "scram: client proof mismatch",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newScramClient("user", test.password)
+			s := newScramServer(secret)
+
+			serverFirst, err := s.first(c.first())
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientFinal, err := c.final(serverFirst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			serverFinal, err := s.final(clientFinal)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("%v != %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.verify(serverFinal); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestParseScramSecret(t *testing.T) {
+	secret := newScramSecret("pencil", []byte("0123456789abcdef"), 4096)
+	v := fmt.Sprintf("SCRAM-SHA-256$%d:%s$%s:%s",
+		secret.iter,
+		base64.StdEncoding.EncodeToString(secret.salt),
+		base64.StdEncoding.EncodeToString(secret.storedKey),
+		base64.StdEncoding.EncodeToString(secret.serverKey))
+	actual, err := parseScramSecret(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, secret) {
+		t.Fatalf("%v != %v", actual, secret)
+	}
+
+	for _, invalid := range []string{
+		"md5abc",
+		"SCRAM-SHA-256$4096:salt",
+		"SCRAM-SHA-256$x:AAAA$AAAA:AAAA",
+		"SCRAM-SHA-256$4096:!!$AAAA:AAAA",
+	} {
+		if _, err := parseScramSecret(invalid); err == nil {
+			t.Fatalf("no error occurred: %s", invalid)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// runSecretCommand runs command through the shell and returns the first line of its output.
+// env is added to the environment of the command.
+func runSecretCommand(command string, env ...string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	cmd.Stderr = os.Stderr
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("`%s`: %w", command, err)
+	}
+
+	line, _, _ := bufio.NewReader(bytes.NewReader(out)).ReadLine()
+	return string(line), nil
+}
+
+var promptMutex sync.Mutex
+
+// promptTTY asks on the controlling terminal without echo.
+// Fails unless the process is running in the foreground.
+func promptTTY(prompt string) (string, error) {
+	promptMutex.Lock()
+	defer promptMutex.Unlock()
+
+	tty, err := openForegroundTTY()
+	if err != nil {
+		return "", err
+	}
+	defer tty.Close()
+
+	if _, err := fmt.Fprint(tty, prompt); err != nil {
+		return "", err
+	}
+	v, err := readPassword(tty)
+	fmt.Fprintln(tty)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(v), "\r\n"), nil
+}
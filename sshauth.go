@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var sshAuthMethods = map[string]bool{
+	"publickey":            true,
+	"keyboard-interactive": true,
+	"password":             true,
+}
+
+func (c *sshTunnelSshConfig) password() (string, error) {
+	if c.passwordCommand != "" {
+		return runSecretCommand(c.passwordCommand)
+	}
+	return promptTTY(fmt.Sprintf("%s@%s's password: ", c.user, c.addr))
+}
+
+// answer answers one keyboard-interactive question.
+// the question is passed to keyboard_interactive command as $PG_SSH_PROXY_PROMPT.
+func (c *sshTunnelSshConfig) answer(instruction, question string) (string, error) {
+	if c.keyboardInteractive != "" {
+		return runSecretCommand(c.keyboardInteractive, "PG_SSH_PROXY_PROMPT="+question)
+	}
+	if instruction != "" {
+		question = instruction + "\n" + question
+	}
+	return promptTTY(fmt.Sprintf("(%s@%s) %s", c.user, c.addr, question))
+}
+
+// authMethods returns ssh.AuthMethod in the order of config.auth.
+func authMethods(config sshTunnelSshConfig, signers []ssh.Signer) []ssh.AuthMethod {
+	auth := config.auth
+	if auth == nil {
+		auth = []string{"publickey"}
+	}
+
+	var r []ssh.AuthMethod
+	for _, method := range auth {
+		switch method {
+		case "publickey":
+			r = append(r, ssh.PublicKeys(signers...))
+		case "password":
+			r = append(r, ssh.PasswordCallback(config.password))
+		case "keyboard-interactive":
+			r = append(r, ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, 0, len(questions))
+				for _, q := range questions {
+					a, err := config.answer(instruction, q)
+					if err != nil {
+						return nil, err
+					}
+					answers = append(answers, a)
+				}
+				return answers, nil
+			}))
+		}
+	}
+	return r
+}
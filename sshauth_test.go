@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func startTestSshPasswordServer(t *testing.T) *testSshServer {
+	sconf := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, pubkey ssh.PublicKey) (*ssh.Permissions, error) {
+			return &ssh.Permissions{}, nil
+		},
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "secret" {
+				return nil, fmt.Errorf("wrong password")
+			}
+			return &ssh.Permissions{}, nil
+		},
+		KeyboardInteractiveCallback: func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := client("", "one time password", []string{"Password: ", "OTP: "}, []bool{false, true})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != 2 || answers[0] != "secret" || answers[1] != "123456" {
+				return nil, fmt.Errorf("wrong answers")
+			}
+			return &ssh.Permissions{}, nil
+		},
+	}
+	skey, err := ssh.ParsePrivateKey([]byte(serverHostKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sconf.AddHostKey(skey)
+	return serveTestSsh(t, false, sconf)
+}
+
+func TestDialSshTunnelAuth(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("keyboard_interactive command is a POSIX shell script")
+	}
+	srv := startTestSshPasswordServer(t)
+
+	answer := `case "$PG_SSH_PROXY_PROMPT" in "Password: ") echo secret;; "OTP: ") echo 123456;; esac`
+
+	tests := []struct {
+		name                string
+		idents              []string
+		auth                []string
+		passwordCommand     string
+		keyboardInteractive string
+		err                 bool
+	}{
+		{
+			name:            "password",
+			auth:            []string{"password"},
+			passwordCommand: "echo secret",
+		},
+		{
+			name:            "wrong_password",
+			auth:            []string{"password"},
+			passwordCommand: "echo wrong",
+			err:             true,
+		},
+		{
+			name:                "keyboard_interactive",
+			auth:                []string{"keyboard-interactive"},
+			keyboardInteractive: answer,
+		},
+		{
+			name:                "wrong_answer",
+			auth:                []string{"keyboard-interactive"},
+			keyboardInteractive: "echo wrong",
+			err:                 true,
+		},
+		{
+			name:            "fallback_to_publickey",
+			idents:          []string{"/id_ed25519"},
+			auth:            []string{"password", "publickey"},
+			passwordCommand: "echo wrong",
+		},
+		{
+			name:            "publickey_not_allowed",
+			idents:          []string{"/id_ed25519"},
+			auth:            []string{"password"},
+			passwordCommand: "echo wrong",
+			err:             true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := sshTunnelSshConfig{
+				fs: testDialSshTunnelFs{
+					knownhosts: srv.knownhosts(),
+				},
+				user:       "guest",
+				idents:     test.idents,
+				addr:       srv.addr(),
+				knownHosts: "/known_hosts",
+
+				auth:                test.auth,
+				passwordCommand:     test.passwordCommand,
+				keyboardInteractive: test.keyboardInteractive,
+			}
+			tun, err := dialSshTunnel(config, ":22")
+			if test.err {
+				if err == nil {
+					tun.Close()
+					t.Fatal("no error occurred.")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tun.Close()
+			testEcho(t, tun)
+		})
+	}
+}
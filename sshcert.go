@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func certTime(t uint64) string {
+	return time.Unix(int64(t), 0).Format(time.RFC3339)
+}
+
+// checkCertValidity reports an expired or not yet valid certificate with its period.
+func checkCertValidity(cert *ssh.Certificate, now time.Time) error {
+	unix := uint64(now.Unix())
+	if unix < cert.ValidAfter {
+		return fmt.Errorf("certificate %q is not yet valid (valid after %s)", cert.KeyId, certTime(cert.ValidAfter))
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && unix >= cert.ValidBefore {
+		return fmt.Errorf("certificate %q has expired (valid before %s)", cert.KeyId, certTime(cert.ValidBefore))
+	}
+	return nil
+}
+
+// loadCertificate pairs `<ident>-cert.pub` with signer.
+func loadCertificate(config sshTunnelSshConfig, ident string, signer ssh.Signer) (ssh.Signer, error) {
+	name := ident + "-cert.pub"
+	b, err := fs.ReadFile(config.fs, name)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s: not a certificate", name)
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("%s: not a user certificate", name)
+	}
+	if err := checkCertValidity(cert, time.Now()); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	cs, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return cs, nil
+}
+
+type hostAuthority struct {
+	hosts []string
+	key   ssh.PublicKey
+}
+
+// parseHostAuthorities collects `@cert-authority` lines in known_hosts.
+func parseHostAuthorities(b []byte) ([]hostAuthority, error) {
+	var r []hostAuthority
+	for len(b) > 0 {
+		marker, hosts, key, _, rest, err := ssh.ParseKnownHosts(b)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if marker == "cert-authority" {
+			r = append(r, hostAuthority{
+				hosts: hosts,
+				key:   key,
+			})
+		}
+		b = rest
+	}
+	return r, nil
+}
+
+func isHostAuthority(authorities []hostAuthority, auth ssh.PublicKey, address string) bool {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return false
+	}
+	// a bare host matches port 22 only. other ports are written as [host]:port.
+	name := knownhosts.Normalize(address)
+
+	for _, a := range authorities {
+		if bytes.Equal(a.key.Marshal(), auth.Marshal()) && matchSshPatternList(a.hosts, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// newHostKeyCallback verifies host certificates against `@cert-authority` lines and plain keys with fallback.
+func newHostKeyCallback(knownHosts []byte, fallback ssh.HostKeyCallback) (ssh.HostKeyCallback, error) {
+	authorities, err := parseHostAuthorities(knownHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return isHostAuthority(authorities, auth, address)
+		},
+		HostKeyFallback: fallback,
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := checker.CheckHostKey(hostname, remote, key)
+		if cert, ok := key.(*ssh.Certificate); ok && err != nil {
+			if verr := checkCertValidity(cert, time.Now()); verr != nil {
+				return fmt.Errorf("host %w", verr)
+			}
+			return fmt.Errorf("host certificate %q: %w", cert.KeyId, err)
+		}
+		return err
+	}, nil
+}
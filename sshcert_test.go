@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCheckCertValidity(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+
+	tests := []struct {
+		name        string
+		validAfter  uint64
+		validBefore uint64
+		err         string
+	}{
+		{
+			name:        "valid",
+			validAfter:  999_999,
+			validBefore: 1_000_001,
+		},
+		{
+			name:        "forever",
+			validBefore: ssh.CertTimeInfinity,
+		},
+		{
+			name:        "not_yet_valid",
+			validAfter:  1_000_001,
+			validBefore: ssh.CertTimeInfinity,
+			err:         fmt.Sprintf(`certificate "test" is not yet valid (valid after %s)`, certTime(1_000_001)),
+		},
+		{
+			name:        "expired",
+			validBefore: 1_000_000,
+			err:         fmt.Sprintf(`certificate "test" has expired (valid before %s)`, certTime(1_000_000)),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cert := &ssh.Certificate{
+				KeyId:       "test",
+				ValidAfter:  test.validAfter,
+				ValidBefore: test.validBefore,
+			}
+			err := checkCertValidity(cert, now)
+			if test.err != "" {
+				if err == nil {
+					t.Fatal("no error occurred.")
+				}
+				if err.Error() != test.err {
+					t.Fatalf("%s != %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestIsHostAuthority(t *testing.T) {
+	ca, err := ssh.ParsePrivateKey([]byte(serverHostKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ssh.ParsePrivateKey([]byte(identityKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorities, err := parseHostAuthorities([]byte(fmt.Sprintf(`# comment
+example.com %s
+@cert-authority *.example.com,!db.example.com %s
+
+@cert-authority [bastion.example.com]:2222 %s
+`, identityKeyPub, serverHostKeyPub, serverHostKeyPub)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(authorities) != 2 {
+		t.Fatalf("%d != 2", len(authorities))
+	}
+
+	tests := []struct {
+		auth  ssh.PublicKey
+		addr  string
+		wants bool
+	}{
+		{ca.PublicKey(), "www.example.com:22", true},
+		{ca.PublicKey(), "db.example.com:22", false},
+		{ca.PublicKey(), "example.org:22", false},
+		{other.PublicKey(), "www.example.com:22", false},
+		{ca.PublicKey(), "bastion.example.com:2222", true},
+		{ca.PublicKey(), "bastion.example.com:22", true},
+		{ca.PublicKey(), "www.example.com:2222", false},
+		{ca.PublicKey(), "bastion.example.com:2200", false},
+	}
+	for _, test := range tests {
+		if r := isHostAuthority(authorities, test.auth, test.addr); r != test.wants {
+			t.Errorf("%s: %v != %v", test.addr, r, test.wants)
+		}
+	}
+}
+
+func newTestCert(t *testing.T, ca ssh.Signer, key ssh.PublicKey, certType uint32, principal string, validBefore uint64) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          1,
+		CertType:        certType,
+		KeyId:           principal,
+		ValidPrincipals: []string{principal},
+		ValidBefore:     validBefore,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestDialSshTunnelCertificate(t *testing.T) {
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.ParsePrivateKey([]byte(serverHostKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ident, err := ssh.ParsePrivateKey([]byte(identityKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := uint64(time.Now().Add(time.Hour).Unix())
+	expired := uint64(time.Now().Add(-time.Hour).Unix())
+
+	serve := func(t *testing.T, validBefore uint64) *testSshServer {
+		checker := &ssh.CertChecker{
+			IsUserAuthority: func(auth ssh.PublicKey) bool {
+				return string(auth.Marshal()) == string(ca.PublicKey().Marshal())
+			},
+		}
+		sconf := &ssh.ServerConfig{
+			PublicKeyCallback: checker.Authenticate,
+		}
+		hostCert := newTestCert(t, ca, hostKey.PublicKey(), ssh.HostCert, "::1", validBefore)
+		hostSigner, err := ssh.NewCertSigner(hostCert, hostKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sconf.AddHostKey(hostSigner)
+		return serveTestSsh(t, false, sconf)
+	}
+
+	tests := []struct {
+		name     string
+		hostCert uint64
+		userCert uint64
+		err      string
+	}{
+		{
+			name:     "valid",
+			hostCert: valid,
+			userCert: valid,
+		},
+		{
+			name:     "host_cert_expired",
+			hostCert: expired,
+			userCert: valid,
+			err:      `host certificate "::1" has expired`,
+		},
+		{
+			name:     "user_cert_expired",
+			hostCert: valid,
+			userCert: expired,
+			err:      `/id_ed25519-cert.pub: certificate "guest" has expired`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := serve(t, test.hostCert)
+			userCert := newTestCert(t, ca, ident.PublicKey(), ssh.UserCert, "guest", test.userCert)
+
+			config := sshTunnelSshConfig{
+				fs: testDialSshTunnelFs{
+					knownhosts: fmt.Sprintf("@cert-authority [::1]:* %s\n", ssh.MarshalAuthorizedKey(ca.PublicKey())),
+					files: map[string]string{
+						"/id_ed25519-cert.pub": string(ssh.MarshalAuthorizedKey(userCert)),
+					},
+				},
+				user:       "guest",
+				idents:     []string{"/id_ed25519"},
+				addr:       srv.addr(),
+				knownHosts: "/known_hosts",
+			}
+			tun, err := dialSshTunnel(config, ":5432")
+			if test.err != "" {
+				if err == nil {
+					tun.Close()
+					t.Fatal("no error occurred.")
+				}
+				if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("%s does not contain %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tun.Close()
+			testEcho(t, tun)
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os/user"
+	"path"
+	"strings"
+)
+
+// sshConfigHost is the options resolved for one Host alias from ssh_config(5).
+// Keywords are lower case. The first obtained value wins except for multi-value keywords.
+type sshConfigHost struct {
+	alias  string
+	values map[string][]string
+}
+
+var sshConfigMultiValue = map[string]bool{
+	"identityfile":    true,
+	"certificatefile": true,
+}
+
+func (h *sshConfigHost) get(key string) string {
+	if v := h.values[key]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (h *sshConfigHost) getAll(key string) []string {
+	return h.values[key]
+}
+
+func (h *sshConfigHost) set(key string, args []string) {
+	if sshConfigMultiValue[key] {
+		h.values[key] = append(h.values[key], args[0])
+		return
+	}
+	if _, exists := h.values[key]; !exists {
+		h.values[key] = args
+	}
+}
+
+// hostname for matching. HostName if already obtained.
+func (h *sshConfigHost) hostname() string {
+	if v := h.get("hostname"); v != "" {
+		return h.expand(v)
+	}
+	return h.alias
+}
+
+func (h *sshConfigHost) port() string {
+	if v := h.get("port"); v != "" {
+		return v
+	}
+	return "22"
+}
+
+func (h *sshConfigHost) user() string {
+	if v := h.get("user"); v != "" {
+		return v
+	}
+	if u, _ := user.Current(); u != nil {
+		return u.Username
+	}
+	return ""
+}
+
+// expand expands tokens (%h, %p, %r, %u, %d, %%) in v.
+func (h *sshConfigHost) expand(v string) string {
+	b := strings.Builder{}
+	for i := 0; i < len(v); i++ {
+		if v[i] != '%' || i+1 >= len(v) {
+			b.WriteByte(v[i])
+			continue
+		}
+		i++
+		switch v[i] {
+		case 'h':
+			if hn := h.get("hostname"); hn != "" && !strings.Contains(hn, "%") {
+				b.WriteString(hn)
+			} else {
+				b.WriteString(h.alias)
+			}
+		case 'n':
+			b.WriteString(h.alias)
+		case 'p':
+			b.WriteString(h.port())
+		case 'r':
+			b.WriteString(h.user())
+		case 'u':
+			if u, _ := user.Current(); u != nil {
+				b.WriteString(u.Username)
+			}
+		case 'd':
+			b.WriteString("~")
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(v[i])
+		}
+	}
+	return b.String()
+}
+
+// splitSshConfigLine splits a line into keyword and arguments. `Keyword=value` and quoted arguments are accepted.
+func splitSshConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return "", nil, fmt.Errorf("missing argument: %s", line)
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = strings.TrimLeft(rest[1:], " \t")
+	}
+
+	var args []string
+	for rest != "" {
+		if rest[0] == '#' {
+			break
+		}
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return "", nil, fmt.Errorf("unterminated quote: %s", line)
+			}
+			args = append(args, rest[1:end+1])
+			rest = strings.TrimLeft(rest[end+2:], " \t")
+			continue
+		}
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			end = len(rest)
+		}
+		args = append(args, rest[:end])
+		rest = strings.TrimLeft(rest[end:], " \t")
+	}
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("missing argument: %s", line)
+	}
+	return keyword, args, nil
+}
+
+// matchSshPattern matches v against a pattern with `*` and `?` wildcards.
+func matchSshPattern(pattern, v string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := 0; i <= len(v); i++ {
+				if matchSshPattern(pattern[1:], v[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(v) == 0 {
+				return false
+			}
+		default:
+			if len(v) == 0 || pattern[0] != v[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		v = v[1:]
+	}
+	return len(v) == 0
+}
+
+// matchSshPatternList matches v against patterns. A negated pattern (`!pat`) wins.
+func matchSshPatternList(patterns []string, v string) bool {
+	matched := false
+	for _, p := range patterns {
+		for _, p := range strings.Split(p, ",") {
+			if strings.HasPrefix(p, "!") {
+				if matchSshPattern(p[1:], v) {
+					return false
+				}
+				continue
+			}
+			if matchSshPattern(p, v) {
+				matched = true
+			}
+		}
+	}
+	return matched
+}
+
+func (h *sshConfigHost) match(args []string) (bool, error) {
+	for i := 0; i < len(args); i++ {
+		criteria := strings.ToLower(args[i])
+		negate := strings.HasPrefix(criteria, "!")
+		criteria = strings.TrimPrefix(criteria, "!")
+
+		var r bool
+		switch criteria {
+		case "all":
+			r = true
+		case "host", "originalhost", "user", "localuser", "exec":
+			if i+1 >= len(args) {
+				return false, fmt.Errorf("Match %s: missing argument", criteria)
+			}
+			i++
+			patterns := []string{args[i]}
+			switch criteria {
+			case "host":
+				r = matchSshPatternList(patterns, h.hostname())
+			case "originalhost":
+				r = matchSshPatternList(patterns, h.alias)
+			case "user":
+				r = matchSshPatternList(patterns, h.user())
+			case "localuser":
+				if u, _ := user.Current(); u != nil {
+					r = matchSshPatternList(patterns, u.Username)
+				}
+			case "exec":
+				// never run commands from ssh_config.
+				r = false
+			}
+		case "canonical":
+			r = false
+		case "final":
+			r = true
+		default:
+			return false, fmt.Errorf("Match: unsupported criteria `%s`", criteria)
+		}
+
+		if r == negate {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+const sshConfigMaxInclude = 16
+
+func (h *sshConfigHost) read(fsys fs.FS, dir, name string, depth int) error {
+	if depth > sshConfigMaxInclude {
+		return fmt.Errorf("%s: too many nested Include", name)
+	}
+
+	fp, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	active := true
+	scanner := bufio.NewScanner(fp)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		keyword, args, err := splitSshConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", name, lineno, err)
+		}
+
+		switch keyword {
+		case "":
+			continue
+
+		case "host":
+			active = matchSshPatternList(args, h.alias)
+
+		case "match":
+			active, err = h.match(args)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", name, lineno, err)
+			}
+
+		case "include":
+			if !active {
+				continue
+			}
+			for _, pattern := range args {
+				if !path.IsAbs(pattern) && !strings.HasPrefix(pattern, "~") {
+					pattern = path.Join(dir, pattern)
+				}
+				matches, err := fs.Glob(fsys, pattern)
+				if err != nil {
+					return fmt.Errorf("%s:%d: %w", name, lineno, err)
+				}
+				for _, m := range matches {
+					if err := h.read(fsys, dir, m, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+
+		default:
+			if active {
+				h.set(keyword, args)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// lookupSshConfig resolves options for alias from ssh_config(5) at name.
+// Relative Include is resolved from the directory of name.
+func lookupSshConfig(fsys fs.FS, name, alias string) (*sshConfigHost, error) {
+	h := &sshConfigHost{
+		alias:  alias,
+		values: map[string][]string{},
+	}
+	if err := h.read(fsys, path.Dir(name), name, 0); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"os/user"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSplitSshConfigLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		keyword string
+		args    []string
+		err     string
+	}{
+		{
+			name: "empty",
+			line: "  ",
+		},
+		{
+			name: "comment",
+			line: "# HostName example.com",
+		},
+		{
+			name:    "simple",
+			line:    "  HostName example.com",
+			keyword: "hostname",
+			args:    []string{"example.com"},
+		},
+		{
+			name:    "equal",
+			line:    "Port = 2222",
+			keyword: "port",
+			args:    []string{"2222"},
+		},
+		{
+			name:    "multiple",
+			line:    "Host a b\tc # comment",
+			keyword: "host",
+			args:    []string{"a", "b", "c"},
+		},
+		{
+			name:    "quoted",
+			line:    `IdentityFile "~/.ssh/my key"`,
+			keyword: "identityfile",
+			args:    []string{"~/.ssh/my key"},
+		},
+		{
+			name: "no_argument",
+			line: "HostName",
+			err:  "missing argument: HostName",
+		},
+		{
+			name: "unterminated",
+			line: `IdentityFile "~/.ssh/my key`,
+			err:  `unterminated quote: IdentityFile "~/.ssh/my key`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keyword, args, err := splitSshConfigLine(test.line)
+			if test.err != "" {
+				if err == nil {
+					t.Fatal("no error occurred.")
+				}
+				if err.Error() != test.err {
+					t.Fatalf("%s != %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keyword != test.keyword || !reflect.DeepEqual(args, test.args) {
+				t.Fatalf("%s %#v != %s %#v", keyword, args, test.keyword, test.args)
+			}
+		})
+	}
+}
+
+func TestMatchSshPatternList(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		v        string
+		wants    bool
+	}{
+		{[]string{"*"}, "example.com", true},
+		{[]string{"prod-*"}, "prod-db", true},
+		{[]string{"prod-*"}, "dev-db", false},
+		{[]string{"db?"}, "db1", true},
+		{[]string{"db?"}, "db10", false},
+		{[]string{"a", "b"}, "b", true},
+		{[]string{"a,b"}, "b", true},
+		{[]string{"*", "!prod-*"}, "prod-db", false},
+		{[]string{"!prod-*"}, "dev-db", false},
+	}
+
+	for _, test := range tests {
+		if r := matchSshPatternList(test.patterns, test.v); r != test.wants {
+			t.Errorf("%v %s: %v != %v", test.patterns, test.v, r, test.wants)
+		}
+	}
+}
+
+func TestLookupSshConfig(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := fstest.MapFS{
+		"ssh/config": &fstest.MapFile{
+			Data: []byte(`
+Include config.d/*
+
+Host prod-*
+    User admin
+    IdentityFile ~/.ssh/id_%r
+
+Host prod-bastion
+    HostName bastion.example.com
+    Port 2222
+    User ignored
+
+Match host *.internal
+    UserKnownHostsFile ~/.ssh/known_hosts.internal
+
+Host *
+    IdentityFile ~/.ssh/id_ed25519
+    User=guest
+`),
+		},
+		"ssh/config.d/db": &fstest.MapFile{
+			Data: []byte(`
+Host prod-db
+    HostName db.internal
+    ProxyJump prod-bastion
+`),
+		},
+	}
+
+	tests := []struct {
+		alias    string
+		hostname string
+		port     string
+		user     string
+		values   map[string][]string
+	}{
+		{
+			alias:    "prod-bastion",
+			hostname: "bastion.example.com",
+			port:     "2222",
+			user:     "admin",
+			values: map[string][]string{
+				"user":         {"admin"},
+				"identityfile": {"~/.ssh/id_%r", "~/.ssh/id_ed25519"},
+				"hostname":     {"bastion.example.com"},
+				"port":         {"2222"},
+			},
+		},
+		{
+			alias:    "prod-db",
+			hostname: "db.internal",
+			port:     "22",
+			user:     "admin",
+			values: map[string][]string{
+				"hostname":           {"db.internal"},
+				"proxyjump":          {"prod-bastion"},
+				"user":               {"admin"},
+				"identityfile":       {"~/.ssh/id_%r", "~/.ssh/id_ed25519"},
+				"userknownhostsfile": {"~/.ssh/known_hosts.internal"},
+			},
+		},
+		{
+			alias:    "other",
+			hostname: "other",
+			port:     "22",
+			user:     "guest",
+			values: map[string][]string{
+				"identityfile": {"~/.ssh/id_ed25519"},
+				"user":         {"guest"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.alias, func(t *testing.T) {
+			h, err := lookupSshConfig(fsys, "ssh/config", test.alias)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(h.values, test.values) {
+				t.Fatalf("%#v != %#v", h.values, test.values)
+			}
+			if h.hostname() != test.hostname {
+				t.Fatalf("%s != %s", h.hostname(), test.hostname)
+			}
+			if h.port() != test.port {
+				t.Fatalf("%s != %s", h.port(), test.port)
+			}
+			if h.user() != test.user {
+				t.Fatalf("%s != %s", h.user(), test.user)
+			}
+		})
+	}
+
+	h, err := lookupSshConfig(fsys, "ssh/config", "prod-bastion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := h.expand("%r@%h:%p %n %u %d/%%"); v != "admin@bastion.example.com:2222 prod-bastion "+u.Username+" ~/%" {
+		t.Fatal(v)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshClientPool shares one ssh.Client per sshTunnelSshConfig, so every tunnel
+// to the same bastion only opens a new channel instead of a new connection.
+type sshClientPool struct {
+	idleTimeout time.Duration
+	dial        func(sshTunnelSshConfig) (*ssh.Client, error)
+
+	mu      sync.Mutex
+	clients map[string]*pooledSshClient
+}
+
+type pooledSshClient struct {
+	pool      *sshClientPool
+	key       string
+	client    *ssh.Client
+	keepAlive *sshKeepAlive
+	err       error
+	ready     chan struct{}
+	refs      int
+	idle      *time.Timer
+}
+
+func newSshClientPool(idleTimeout time.Duration) *sshClientPool {
+	return &sshClientPool{
+		idleTimeout: idleTimeout,
+		dial:        dialSshClient,
+		clients:     map[string]*pooledSshClient{},
+	}
+}
+
+func (p *sshClientPool) acquire(config sshTunnelSshConfig) (*pooledSshClient, error) {
+	key := config.key()
+
+	p.mu.Lock()
+	c, exists := p.clients[key]
+	if exists {
+		c.refs++
+		if c.idle != nil {
+			c.idle.Stop()
+			c.idle = nil
+		}
+		p.mu.Unlock()
+
+		<-c.ready
+		if c.err != nil {
+			return nil, c.err
+		}
+		return c, nil
+	}
+
+	c = &pooledSshClient{
+		pool:  p,
+		key:   key,
+		ready: make(chan struct{}),
+		refs:  1,
+	}
+	p.clients[key] = c
+	p.mu.Unlock()
+
+	c.client, c.err = p.dial(config)
+	if c.err != nil {
+		p.forget(c)
+		close(c.ready)
+		return nil, c.err
+	}
+	c.keepAlive = startSshKeepAlive(c.client, config.serverAliveInterval, config.serverAliveCountMax)
+	close(c.ready)
+
+	go func() {
+		// transport dropped. next acquire redials.
+		c.client.Wait()
+		p.forget(c)
+	}()
+	return c, nil
+}
+
+func (p *sshClientPool) forget(c *pooledSshClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.clients[c.key] == c {
+		delete(p.clients, c.key)
+	}
+}
+
+func (c *pooledSshClient) release() error {
+	p := c.pool
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c.refs--
+	if c.refs > 0 {
+		return nil
+	}
+
+	if p.clients[c.key] != c || p.idleTimeout <= 0 {
+		if p.clients[c.key] == c {
+			delete(p.clients, c.key)
+		}
+		return c.client.Close()
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(p.idleTimeout, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		if c.idle != t {
+			return
+		}
+		c.idle = nil
+		if p.clients[c.key] == c {
+			delete(p.clients, c.key)
+		}
+		c.client.Close()
+	})
+	c.idle = t
+	return nil
+}
+
+// close closes every client. tunnels on them are broken.
+func (p *sshClientPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, c := range p.clients {
+		if c.idle != nil {
+			c.idle.Stop()
+			c.idle = nil
+		}
+		select {
+		case <-c.ready:
+			if c.client != nil {
+				c.client.Close()
+			}
+		default:
+			// still dialing. closed by release since no longer pooled.
+		}
+		delete(p.clients, key)
+	}
+}
+
+// retire removes clients whose key is not in keep. idle ones are closed now.
+// others are closed when their last tunnel is released.
+func (p *sshClientPool) retire(keep map[string]bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, c := range p.clients {
+		if keep[key] {
+			continue
+		}
+		delete(p.clients, key)
+		if c.idle != nil {
+			c.idle.Stop()
+			c.idle = nil
+			c.client.Close()
+		}
+	}
+}
+
+func (p *sshClientPool) dialTunnel(config sshTunnelSshConfig, addr string) (*sshTunnel, error) {
+	for retry := 0; ; retry++ {
+		c, err := p.acquire(config)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := dialForward(c.client, addr)
+		if err != nil {
+			var openErr *ssh.OpenChannelError
+			if !errors.As(err, &openErr) {
+				// not rejected by the server. assume transport is gone.
+				p.forget(c)
+			}
+			c.release()
+			if retry == 0 && openErr == nil {
+				continue
+			}
+			return nil, err
+		}
+
+		return &sshTunnel{
+			client:    c.client,
+			conn:      conn,
+			release:   c.release,
+			keepAlive: c.keepAlive,
+		}, nil
+	}
+}
+
+// dialTunnelContext is dialTunnel giving up when cx is done. the dial, which may be blocked
+// by a stalled handshake or a passphrase prompt, goes on and its tunnel is closed.
+func (p *sshClientPool) dialTunnelContext(cx context.Context, config sshTunnelSshConfig, addr string) (*sshTunnel, error) {
+	type result struct {
+		tun *sshTunnel
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		tun, err := p.dialTunnel(config, addr)
+		ch <- result{tun, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.tun, r.err
+	case <-cx.Done():
+		go func() {
+			if r := <-ch; r.tun != nil {
+				r.tun.Close()
+			}
+		}()
+		return nil, cx.Err()
+	}
+}
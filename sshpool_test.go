@@ -0,0 +1,225 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testSshClientPoolConfig(srv *testSshServer) sshTunnelSshConfig {
+	return sshTunnelSshConfig{
+		fs: testDialSshTunnelFs{
+			knownhosts: srv.knownhosts(),
+		},
+		user: "guest",
+		idents: []string{
+			"/id_ed25519",
+		},
+		addr:       srv.addr(),
+		knownHosts: "/known_hosts",
+	}
+}
+
+func testEcho(t *testing.T, tun *sshTunnel) {
+	if _, err := tun.Write([]byte("OK")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(tun, b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(b, []byte("OK")) {
+		t.Fatal(b)
+	}
+}
+
+func TestSshClientPoolShare(t *testing.T) {
+	srv := startTestSshServer(t)
+	pool := newSshClientPool(time.Minute)
+	config := testSshClientPoolConfig(srv)
+
+	tunnels := make([]*sshTunnel, 0, 5)
+	for i := 0; i < 5; i++ {
+		tun, err := pool.dialTunnel(config, ":5432")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tunnels = append(tunnels, tun)
+	}
+	for _, tun := range tunnels {
+		testEcho(t, tun)
+	}
+
+	if n := atomic.LoadInt32(&srv.handshakes); n != 1 {
+		t.Fatalf("%d != 1", n)
+	}
+
+	for _, tun := range tunnels {
+		if err := tun.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// kept while idle.
+	tun, err := pool.dialTunnel(config, ":5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+	testEcho(t, tun)
+
+	if n := atomic.LoadInt32(&srv.handshakes); n != 1 {
+		t.Fatalf("%d != 1", n)
+	}
+}
+
+func TestSshClientPoolIdleTimeout(t *testing.T) {
+	srv := startTestSshServer(t)
+	pool := newSshClientPool(10 * time.Millisecond)
+	config := testSshClientPoolConfig(srv)
+
+	tun, err := pool.dialTunnel(config, ":5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := tun.client
+	if err := tun.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle client not closed.")
+	}
+
+	pool.mu.Lock()
+	n := len(pool.clients)
+	pool.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d != 0", n)
+	}
+}
+
+func TestSshClientPoolRedial(t *testing.T) {
+	srv := startTestSshServer(t)
+	pool := newSshClientPool(time.Minute)
+	config := testSshClientPoolConfig(srv)
+
+	tun, err := pool.dialTunnel(config, ":5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+	testEcho(t, tun)
+
+	srv.disconnect()
+	tun.client.Wait()
+
+	tun2, err := pool.dialTunnel(config, ":5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun2.Close()
+	testEcho(t, tun2)
+
+	if n := atomic.LoadInt32(&srv.handshakes); n != 2 {
+		t.Fatalf("%d != 2", n)
+	}
+}
+
+func TestSshClientPoolUnixSocket(t *testing.T) {
+	srv := startTestSshServer(t)
+	pool := newSshClientPool(time.Minute)
+	config := testSshClientPoolConfig(srv)
+
+	tun, err := pool.dialTunnel(config, "unix:/var/run/postgresql/.s.PGSQL.5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+	testEcho(t, tun)
+
+	srv.mu.Lock()
+	sockets := srv.sockets
+	srv.mu.Unlock()
+	if !reflect.DeepEqual(sockets, []string{"/var/run/postgresql/.s.PGSQL.5432"}) {
+		t.Fatal(sockets)
+	}
+}
+
+func TestSshClientPoolRetire(t *testing.T) {
+	srv := startTestSshServer(t)
+	pool := newSshClientPool(time.Minute)
+	config := testSshClientPoolConfig(srv)
+
+	idle, err := pool.dialTunnel(config, ":5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := idle.Close(); err != nil {
+		t.Fatal(err)
+	}
+	pool.retire(map[string]bool{})
+	// idle one is closed now.
+	idle.client.Wait()
+
+	tun, err := pool.dialTunnel(config, ":5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.retire(map[string]bool{config.key() + "changed": true})
+
+	pool.mu.Lock()
+	n := len(pool.clients)
+	pool.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d != 0", n)
+	}
+
+	// in use until the last tunnel is closed.
+	testEcho(t, tun)
+	if err := tun.Close(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		tun.client.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("retired client not closed.")
+	}
+}
+
+func TestSshClientPoolRetireKeep(t *testing.T) {
+	srv := startTestSshServer(t)
+	pool := newSshClientPool(time.Minute)
+	config := testSshClientPoolConfig(srv)
+
+	tun, err := pool.dialTunnel(config, ":5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun.Close()
+	pool.retire(map[string]bool{config.key(): true})
+
+	tun, err = pool.dialTunnel(config, ":5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+	testEcho(t, tun)
+	if n := atomic.LoadInt32(&srv.handshakes); n != 1 {
+		t.Fatalf("%d != 1", n)
+	}
+}
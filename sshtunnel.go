@@ -1,13 +1,21 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"net"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
+	homedir "github.com/mitchellh/go-homedir"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/crypto/ssh/knownhosts"
 )
 
@@ -17,22 +25,126 @@ type sshTunnelSshConfig struct {
 	addr       string
 	idents     []string
 	knownHosts string
+	agent      string
+
+	strictHostKeyChecking string
+
+	passphraseEnv     string
+	passphraseCommand string
+
+	// auth methods in order. publickey only if nil.
+	auth                []string
+	passwordCommand     string
+	keyboardInteractive string
+
+	// keepalive is disabled if zero.
+	serverAliveInterval time.Duration
+	serverAliveCountMax int
+
+	// dialed in order before addr. like ProxyJump.
+	jump []sshTunnelSshConfig
+
+	// reports each step of dialSshHop if not nil. not a part of key.
+	trace sshDialTrace
+	// bounds each step of dialSshHop if not zero. not a part of key.
+	timeout time.Duration
+}
+
+// sshDialTrace receives a step of dialing: dns, tcp, handshake, host key or auth.
+type sshDialTrace func(step string, elapsed time.Duration, err error)
+
+// dialTCP dials addr. resolves separately if traced.
+func dialTCP(addr string, trace sshDialTrace, timeout time.Duration) (net.Conn, error) {
+	if trace == nil {
+		dialer := net.Dialer{Timeout: timeout}
+		return dialer.Dial("tcp", addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	cx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		cx, cancel = context.WithTimeout(cx, timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	ips, err := net.DefaultResolver.LookupHost(cx, host)
+	trace("dns", time.Since(start), err)
+	if err != nil {
+		return nil, err
+	}
+
+	start = time.Now()
+	// timeout covers every address.
+	dialer := net.Dialer{}
+	if timeout > 0 {
+		dialer.Deadline = start.Add(timeout)
+	}
+	var conn net.Conn
+	for _, ip := range ips {
+		if conn, err = dialer.Dial("tcp", net.JoinHostPort(ip, port)); err == nil {
+			break
+		}
+	}
+	trace("tcp", time.Since(start), err)
+	return conn, err
+}
+
+func errTimedOut(timeout time.Duration) error {
+	return fmt.Errorf("timed out after %s", timeout)
+}
+
+// closeAfter closes c unless stop is called within timeout. stop reports whether it was in time.
+// for ssh channels which do not support deadlines. never closes if timeout is zero.
+func closeAfter(c io.Closer, timeout time.Duration) (stop func() bool) {
+	if timeout == 0 {
+		return func() bool { return true }
+	}
+	timer := time.AfterFunc(timeout, func() { c.Close() })
+	return timer.Stop
+}
+
+func (c *sshTunnelSshConfig) key() string {
+	k := fmt.Sprintf("%s@%s %q %s %s %s %q %s %s %s/%d", c.user, c.addr, c.idents, c.knownHosts, c.agent, c.strictHostKeyChecking, c.auth, c.passwordCommand, c.keyboardInteractive, c.serverAliveInterval, c.serverAliveCountMax)
+	for _, j := range c.jump {
+		k = fmt.Sprintf("%s via [%s]", k, j.key())
+	}
+	return k
 }
 
 type sshTunnel struct {
-	client *ssh.Client
-	conn   net.Conn
+	client    *ssh.Client
+	conn      net.Conn
+	release   func() error
+	keepAlive *sshKeepAlive
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
+// Close closes the channel and releases the client. safe to call more than once.
 func (s *sshTunnel) Close() error {
-	cerr := s.conn.Close()
-	if err := s.client.Close(); err != nil {
-		if cerr != nil {
-			return fmt.Errorf("%w (suppress %s)", err, cerr)
+	s.closeOnce.Do(func() {
+		cerr := s.conn.Close()
+		if err := s.release(); err != nil {
+			if cerr != nil {
+				s.closeErr = fmt.Errorf("%w (suppress %s)", err, cerr)
+				return
+			}
+			s.closeErr = err
+			return
 		}
-		return err
-	}
-	return cerr
+		s.closeErr = cerr
+	})
+	return s.closeErr
+}
+
+// lost returns non-nil if the ssh transport was closed by missing keepalives.
+func (s *sshTunnel) lost() error {
+	return s.keepAlive.Err()
 }
 
 func (s *sshTunnel) Read(b []byte) (int, error) {
@@ -43,21 +155,163 @@ func (s *sshTunnel) Write(b []byte) (int, error) {
 	return s.conn.Write(b)
 }
 
-func dialSshTunnel(config sshTunnelSshConfig, addr string) (*sshTunnel, error) {
+func (s *sshTunnel) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *sshTunnel) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *sshTunnel) SetDeadline(t time.Time) error {
+	return s.conn.SetDeadline(t)
+}
+
+func (s *sshTunnel) SetReadDeadline(t time.Time) error {
+	return s.conn.SetReadDeadline(t)
+}
+
+func (s *sshTunnel) SetWriteDeadline(t time.Time) error {
+	return s.conn.SetWriteDeadline(t)
+}
+
+func (c *sshTunnelSshConfig) passphrase(ident string) ([]byte, error) {
+	if c.passphraseEnv != "" {
+		v, exists := os.LookupEnv(c.passphraseEnv)
+		if !exists {
+			return nil, fmt.Errorf("$%s is not set", c.passphraseEnv)
+		}
+		return []byte(v), nil
+	}
+
+	if c.passphraseCommand != "" {
+		v, err := runSecretCommand(c.passphraseCommand)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(v), nil
+	}
+
+	v, err := promptTTY(fmt.Sprintf("Enter passphrase for key '%s': ", ident))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(v), nil
+}
+
+// decrypted identities. keyed by digest of the key file.
+var identityCache = struct {
+	sync.Mutex
+	signers map[[sha256.Size]byte]ssh.Signer
+}{
+	signers: map[[sha256.Size]byte]ssh.Signer{},
+}
+
+// loadIdentity reads ident. an encrypted one is decrypted on first signing if its public key is known.
+func loadIdentity(config sshTunnelSshConfig, ident string) (ssh.Signer, error) {
+	pem, err := fs.ReadFile(config.fs, ident)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(pem)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return signer, err
+	}
+	if missing.PublicKey == nil {
+		// legacy PEM has no plain public key.
+		return decryptIdentity(config, ident, pem)
+	}
+	return &lazyIdentity{config, ident, pem, missing.PublicKey}, nil
+}
+
+func decryptIdentity(config sshTunnelSshConfig, ident string, pem []byte) (ssh.Signer, error) {
+	identityCache.Lock()
+	defer identityCache.Unlock()
+
+	sum := sha256.Sum256(pem)
+	if signer, exists := identityCache.signers[sum]; exists {
+		return signer, nil
+	}
+
+	passphrase, err := config.passphrase(ident)
+	if err != nil {
+		return nil, fmt.Errorf("encrypted, no passphrase: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKeyWithPassphrase(pem, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	identityCache.signers[sum] = signer
+	return signer, nil
+}
+
+// lazyIdentity is an encrypted identity. the server accepts the public key before it signs,
+// so no passphrase is asked if the agent or another identity has authenticated.
+type lazyIdentity struct {
+	config sshTunnelSshConfig
+	ident  string
+	pem    []byte
+	pub    ssh.PublicKey
+}
+
+func (l *lazyIdentity) PublicKey() ssh.PublicKey {
+	return l.pub
+}
+
+func (l *lazyIdentity) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	signer, err := decryptIdentity(l.config, l.ident, l.pem)
+	if err != nil {
+		return nil, fmt.Errorf("identity %s: %w", l.ident, err)
+	}
+	return signer.Sign(rand, data)
+}
+
+// dialSshHop connects to config.addr. through prev if not nil.
+func dialSshHop(prev *ssh.Client, config sshTunnelSshConfig) (*ssh.Client, error) {
 	signers := make([]ssh.Signer, 0, len(config.idents))
+	if config.agent != "" {
+		// keep agent connection until authenticated. signing is delegated to the agent.
+		sock := config.agent
+		if p, err := homedir.Expand(sock); err == nil {
+			sock = p
+		}
+		if conn, err := net.Dial("unix", sock); err != nil {
+			fmt.Fprintf(os.Stderr, "skip agent %s: %s\n", sock, err)
+		} else {
+			defer conn.Close()
+			if s, err := agent.NewClient(conn).Signers(); err != nil {
+				fmt.Fprintf(os.Stderr, "skip agent %s: %s\n", sock, err)
+			} else {
+				signers = append(signers, s...)
+			}
+		}
+	}
+	var problems []string
 	for _, ident := range config.idents {
-		pem, err := fs.ReadFile(config.fs, ident)
+		signer, err := loadIdentity(config, ident)
 		if err != nil {
+			fmt.Fprintf(os.Stderr, "skip identity %s: %s\n", ident, err)
 			continue
 		}
-		signer, err := ssh.ParsePrivateKey(pem)
-		if err != nil {
-			continue
+
+		cs, err := loadCertificate(config, ident, signer)
+		if err == nil {
+			signers = append(signers, cs)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "skip certificate: %s\n", err)
+			problems = append(problems, err.Error())
 		}
 		signers = append(signers, signer)
 	}
 
 	kh, err := func() (ssh.HostKeyCallback, error) {
+		b, err := fs.ReadFile(config.fs, config.knownHosts)
+		if err != nil && (!config.acceptNewHostKey() || !errors.Is(err, fs.ErrNotExist)) {
+			return nil, err
+		}
+
 		// knownhosts.New -> no fs.FS input.
 		fp, err := os.CreateTemp("", "known_hosts")
 		if err != nil {
@@ -66,42 +320,150 @@ func dialSshTunnel(config sshTunnelSshConfig, addr string) (*sshTunnel, error) {
 		defer fp.Close()
 		defer os.Remove(fp.Name())
 
-		src, err := config.fs.Open(config.knownHosts)
-		if err != nil {
+		if _, err := fp.Write(b); err != nil {
 			return nil, err
 		}
-		defer src.Close()
 
-		if _, err := io.Copy(fp, src); err != nil {
+		known, err := knownhosts.New(fp.Name())
+		if err != nil {
 			return nil, err
 		}
-
-		return knownhosts.New(fp.Name())
+		return newHostKeyCallback(b, verifyHostKey(config, known))
 	}()
 	if err != nil {
 		return nil, err
 	}
 
+	trace := config.trace
+	if trace == nil {
+		trace = func(string, time.Duration, error) {}
+	}
+
+	var hostKeyErr error
+	// host key is verified after key exchange and before auth.
+	var verified time.Time
+	start := time.Now()
 	sshconf := ssh.ClientConfig{
 		User: config.user,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signers...),
+		Auth: authMethods(config, signers),
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			trace("handshake", time.Since(start), nil)
+			at := time.Now()
+			// ssh.NewClientConn does not wrap the callback error.
+			hostKeyErr = kh(hostname, remote, key)
+			trace("host key", time.Since(at), hostKeyErr)
+			verified = time.Now()
+			return hostKeyErr
 		},
-		HostKeyCallback: kh,
 	}
-	client, err := ssh.Dial("tcp", config.addr, &sshconf)
+
+	var conn net.Conn
+	if prev == nil {
+		conn, err = dialTCP(config.addr, config.trace, config.timeout)
+	} else {
+		at := time.Now()
+		// the chain is torn down on failure anyway.
+		stop := closeAfter(prev, config.timeout)
+		conn, err = prev.Dial("tcp", config.addr)
+		if !stop() {
+			if err == nil {
+				conn.Close()
+			}
+			err = errTimedOut(config.timeout)
+		}
+		trace("tcp", time.Since(at), err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	start = time.Now()
+	// ssh.NewClientConn does not honour ssh.ClientConfig.Timeout. bounds handshake and auth.
+	stop := closeAfter(conn, config.timeout)
+	c, chans, reqs, err := ssh.NewClientConn(conn, config.addr, &sshconf)
+	if !stop() {
+		if err == nil {
+			c.Close()
+		}
+		err = errTimedOut(config.timeout)
+	}
+	if err != nil {
+		conn.Close()
+		if hostKeyErr != nil {
+			return nil, fmt.Errorf("ssh: handshake failed: %w", hostKeyErr)
+		}
+		if len(problems) > 0 {
+			err = fmt.Errorf("%w (%s)", err, strings.Join(problems, "; "))
+		}
+		if verified.IsZero() {
+			trace("handshake", time.Since(start), err)
+		} else {
+			trace("auth", time.Since(verified), err)
+		}
+		return nil, err
+	}
+	trace("auth", time.Since(verified), nil)
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+func dialSshClient(config sshTunnelSshConfig) (*ssh.Client, error) {
+	hops := append(append([]sshTunnelSshConfig{}, config.jump...), config)
+
+	var client *ssh.Client
+	for i, hop := range hops {
+		next, err := dialSshHop(client, hop)
+		if err != nil {
+			if client != nil {
+				client.Close()
+			}
+			if len(hops) > 1 {
+				return nil, fmt.Errorf("ssh hop %d/%d %s@%s: %w", i+1, len(hops), hop.user, hop.addr, err)
+			}
+			return nil, fmt.Errorf("ssh %s@%s: %w", hop.user, hop.addr, err)
+		}
+
+		if i < len(hops)-1 {
+			// the last hop is watched by its owner.
+			startSshKeepAlive(next, hop.serverAliveInterval, hop.serverAliveCountMax)
+		}
+		if client != nil {
+			// closing last hop tears down the whole chain.
+			prev := client
+			go func() {
+				next.Wait()
+				prev.Close()
+			}()
+		}
+		client = next
+	}
+	return client, nil
+}
+
+// dialForward opens direct-tcpip channel to addr.
+// or direct-streamlocal@openssh.com channel if addr is `unix:/path`.
+func dialForward(client *ssh.Client, addr string) (net.Conn, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		return client.Dial("unix", strings.TrimPrefix(addr, "unix:"))
+	}
+	return client.Dial("tcp", addr)
+}
+
+func dialSshTunnel(config sshTunnelSshConfig, addr string) (*sshTunnel, error) {
+	client, err := dialSshClient(config)
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := client.Dial("tcp", addr)
+	conn, err := dialForward(client, addr)
 	if err != nil {
 		client.Close()
 		return nil, err
 	}
 
 	return &sshTunnel{
-		client: client,
-		conn:   conn,
+		client:    client,
+		conn:      conn,
+		release:   client.Close,
+		keepAlive: startSshKeepAlive(client, config.serverAliveInterval, config.serverAliveCountMax),
 	}, nil
 }
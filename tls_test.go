@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func testTLSConfig(t *testing.T) (*tls.Config, *x509.CertPool) {
+	certPEM, keyPEM, err := generateSelfSignedCert([]string{"localhost"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(certPEM) {
+		t.Fatal("no certificate")
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, roots
+}
+
+// handleTestPostgresReady completes startup without authentication.
+func handleTestPostgresReady(conn net.Conn) {
+	var pkt rawInitialPacket
+	if err := pkt.read(conn); err != nil {
+		return
+	}
+	for _, raw := range []rawPacket{
+		{'R', []byte{0, 0, 0, 0}},
+		{'Z', []byte{'I'}},
+	} {
+		if err := raw.write(conn); err != nil {
+			return
+		}
+	}
+	io.Copy(io.Discard, conn)
+}
+
+func TestServeTLS(t *testing.T) {
+	pg := startTestPostgres(t, handleTestPostgresReady)
+	serverTLS, roots := testTLSConfig(t)
+
+	tests := []struct {
+		name     string
+		tls      *tls.Config
+		database string
+		answer   byte
+		wants    byte
+	}{
+		{
+			name:     "tls",
+			tls:      serverTLS,
+			database: "db",
+			answer:   'S',
+			wants:    'R',
+		},
+		{
+			name:     "tls_error",
+			tls:      serverTLS,
+			database: "notexists",
+			answer:   'S',
+			wants:    'E',
+		},
+		{
+			name:     "no_tls",
+			database: "db",
+			answer:   'N',
+			wants:    'R',
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(startTestSshJumpServer(t), map[string]*Connection{
+				"db": {
+					Addr:   pg,
+					Dbname: "db",
+				},
+			})
+			s.tls = test.tls
+
+			var client net.Conn = testServe(t, s)
+			req := (&sslRequest{}).toRaw()
+			if err := req.write(client); err != nil {
+				t.Fatal(err)
+			}
+			answer := make([]byte, 1)
+			if _, err := io.ReadFull(client, answer); err != nil {
+				t.Fatal(err)
+			}
+			if answer[0] != test.answer {
+				t.Fatalf("%c != %c", answer[0], test.answer)
+			}
+			if answer[0] == 'S' {
+				client = tls.Client(client, &tls.Config{
+					RootCAs:    roots,
+					ServerName: "localhost",
+				})
+			}
+
+			startup := (&startupMessage{map[string]string{"database": test.database, "user": "guest"}}).toRaw()
+			if err := startup.write(client); err != nil {
+				t.Fatal(err)
+			}
+			var pkt rawPacket
+			if err := pkt.read(client, noMessageSizeLimit); err != nil {
+				t.Fatal(err)
+			}
+			if pkt.header != test.wants {
+				t.Fatalf("%c != %c", pkt.header, test.wants)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func openForegroundTTY() (*os.File, error) {
+	return nil, fmt.Errorf("prompt is not supported on this platform")
+}
+
+func readPassword(tty *os.File) ([]byte, error) {
+	return nil, fmt.Errorf("prompt is not supported on this platform")
+}
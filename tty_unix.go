@@ -0,0 +1,29 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+func openForegroundTTY() (*os.File, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("no controlling terminal: %w", err)
+	}
+
+	pgrp, err := unix.IoctlGetInt(int(tty.Fd()), unix.TIOCGPGRP)
+	if err != nil || pgrp != unix.Getpgrp() {
+		tty.Close()
+		return nil, fmt.Errorf("not running in the foreground")
+	}
+	return tty, nil
+}
+
+func readPassword(tty *os.File) ([]byte, error) {
+	return term.ReadPassword(int(tty.Fd()))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"strings"
+)
+
+var upstreamSslmodes = map[string]bool{
+	"disable":     true,
+	"prefer":      true,
+	"require":     true,
+	"verify-ca":   true,
+	"verify-full": true,
+}
+
+func (c *Connection) rootCAs(fsys fs.FS) (*x509.CertPool, error) {
+	if c.Sslrootcert == "" || c.Sslrootcert == "system" {
+		return x509.SystemCertPool()
+	}
+
+	b, err := fs.ReadFile(fsys, c.Sslrootcert)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s: no certificate", c.Sslrootcert)
+	}
+	return roots, nil
+}
+
+// upstreamTLSConfig builds tls.Config like libpq sslmode.
+func (c *Connection) upstreamTLSConfig(fsys fs.FS) (*tls.Config, error) {
+	conf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if c.Sslcert != "" {
+		certPEM, err := fs.ReadFile(fsys, c.Sslcert)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err := fs.ReadFile(fsys, c.Sslkey)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	mode := c.Sslmode
+	if mode == "require" && c.Sslrootcert != "" {
+		// like libpq. require with root certificate is verify-ca.
+		mode = "verify-ca"
+	}
+	switch mode {
+	case "prefer", "require":
+		conf.InsecureSkipVerify = true
+
+	case "verify-ca":
+		roots, err := c.rootCAs(fsys)
+		if err != nil {
+			return nil, err
+		}
+		// verify chain without host name.
+		conf.InsecureSkipVerify = true
+		conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			certs := make([]*x509.Certificate, 0, len(rawCerts))
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				certs = append(certs, cert)
+			}
+			if len(certs) == 0 {
+				return fmt.Errorf("no server certificate")
+			}
+			opts := x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range certs[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(opts)
+			return err
+		}
+
+	case "verify-full":
+		roots, err := c.rootCAs(fsys)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = roots
+		conf.ServerName = "localhost"
+		if !strings.HasPrefix(c.Addr, "unix:") {
+			host, _, err := net.SplitHostPort(c.Addr)
+			if err != nil {
+				return nil, err
+			}
+			conf.ServerName = host
+		}
+	}
+	return conf, nil
+}
+
+// startUpstreamTLS sends SSLRequest to up and wraps it by TLS according to sslmode.
+// returns up as is for disable, or prefer without server support.
+func startUpstreamTLS(up net.Conn, entry *Connection, fsys fs.FS) (net.Conn, error) {
+	if entry.Sslmode == "" || entry.Sslmode == "disable" {
+		return up, nil
+	}
+
+	conf, err := entry.upstreamTLSConfig(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	req := (&sslRequest{}).toRaw()
+	if err := req.write(up); err != nil {
+		return nil, err
+	}
+	answer := make([]byte, 1)
+	if _, err := io.ReadFull(up, answer); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	switch answer[0] {
+	case 'S':
+		tlsConn := tls.Client(up, conf)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, fmt.Errorf("upstream tls: %w", err)
+		}
+		return tlsConn, nil
+	case 'N':
+		if entry.Sslmode == "prefer" {
+			return up, nil
+		}
+		return nil, fmt.Errorf("upstream does not support SSL, but sslmode is %s", entry.Sslmode)
+	default:
+		return nil, fmt.Errorf("unexpected response to SSLRequest: %q", answer[0])
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func testCertificatePEM(t *testing.T, hosts ...string) (string, string) {
+	certPEM, keyPEM, err := generateSelfSignedCert(hosts, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(certPEM), string(keyPEM)
+}
+
+// handleTestPostgresSSL answers SSLRequest by conf. reports TLS usage as ParameterStatus ssl.
+func handleTestPostgresSSL(conf *tls.Config) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		var pkt rawInitialPacket
+		if err := pkt.read(conn); err != nil {
+			return
+		}
+		p, err := pkt.toConcrete()
+		if err != nil {
+			return
+		}
+
+		ssl := "off"
+		if _, ok := p.(*sslRequest); ok {
+			if conf == nil {
+				if _, err := conn.Write([]byte("N")); err != nil {
+					return
+				}
+			} else {
+				if _, err := conn.Write([]byte("S")); err != nil {
+					return
+				}
+				tlsConn := tls.Server(conn, conf)
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				conn = tlsConn
+				ssl = "on"
+			}
+			if err := pkt.read(conn); err != nil {
+				return
+			}
+		}
+
+		for _, raw := range []rawPacket{
+			{'R', []byte{0, 0, 0, 0}},
+			{'S', []byte("ssl\x00" + ssl + "\x00")},
+			{'Z', []byte{'I'}},
+		} {
+			if err := raw.write(conn); err != nil {
+				return
+			}
+		}
+		io.Copy(io.Discard, conn)
+	}
+}
+
+func TestServeUpstreamTLS(t *testing.T) {
+	serverCert, serverKey := testCertificatePEM(t, "localhost", "::1")
+	localhostCert, localhostKey := testCertificatePEM(t, "localhost")
+	otherCert, _ := testCertificatePEM(t, "localhost", "::1")
+	clientCert, clientKey := testCertificatePEM(t, "guest")
+
+	serverConf := func(certPEM, keyPEM string, clientAuth tls.ClientAuthType) *tls.Config {
+		cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   clientAuth,
+		}
+	}
+	plain := startTestPostgres(t, handleTestPostgresSSL(nil))
+	withTLS := startTestPostgres(t, handleTestPostgresSSL(serverConf(serverCert, serverKey, tls.NoClientCert)))
+	localhost := startTestPostgres(t, handleTestPostgresSSL(serverConf(localhostCert, localhostKey, tls.NoClientCert)))
+	clientAuth := startTestPostgres(t, handleTestPostgresSSL(serverConf(serverCert, serverKey, tls.RequireAnyClientCert)))
+
+	tests := []struct {
+		name  string
+		addr  string
+		entry Connection
+		ssl   string
+	}{
+		{
+			name:  "disable",
+			addr:  withTLS,
+			entry: Connection{Sslmode: "disable"},
+			ssl:   "off",
+		},
+		{
+			name:  "prefer_plain",
+			addr:  plain,
+			entry: Connection{Sslmode: "prefer"},
+			ssl:   "off",
+		},
+		{
+			name:  "prefer",
+			addr:  withTLS,
+			entry: Connection{Sslmode: "prefer"},
+			ssl:   "on",
+		},
+		{
+			name:  "require_plain",
+			addr:  plain,
+			entry: Connection{Sslmode: "require"},
+		},
+		{
+			name:  "require",
+			addr:  withTLS,
+			entry: Connection{Sslmode: "require"},
+			ssl:   "on",
+		},
+		{
+			name:  "verify_full",
+			addr:  withTLS,
+			entry: Connection{Sslmode: "verify-full", Sslrootcert: "/root.crt"},
+			ssl:   "on",
+		},
+		{
+			name:  "verify_full_other_root",
+			addr:  withTLS,
+			entry: Connection{Sslmode: "verify-full", Sslrootcert: "/other.crt"},
+		},
+		{
+			name:  "require_other_root",
+			addr:  withTLS,
+			entry: Connection{Sslmode: "require", Sslrootcert: "/other.crt"},
+		},
+		{
+			name:  "prefer_other_root",
+			addr:  withTLS,
+			entry: Connection{Sslmode: "prefer", Sslrootcert: "/other.crt"},
+			ssl:   "on",
+		},
+		{
+			name:  "verify_ca",
+			addr:  localhost,
+			entry: Connection{Sslmode: "verify-ca", Sslrootcert: "/localhost.crt"},
+			ssl:   "on",
+		},
+		{
+			name:  "verify_full_host_mismatch",
+			addr:  localhost,
+			entry: Connection{Sslmode: "verify-full", Sslrootcert: "/localhost.crt"},
+		},
+		{
+			name:  "client_cert",
+			addr:  clientAuth,
+			entry: Connection{Sslmode: "require", Sslcert: "/client.crt", Sslkey: "/client.key"},
+			ssl:   "on",
+		},
+		{
+			name:  "no_client_cert",
+			addr:  clientAuth,
+			entry: Connection{Sslmode: "require"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := startTestSshJumpServer(t)
+			entry := test.entry
+			entry.Addr = test.addr
+			entry.Dbname = "db"
+			s := newTestServer(srv, map[string]*Connection{
+				"db": &entry,
+			})
+			s.config.fs = testDialSshTunnelFs{
+				knownhosts: srv.knownhosts(),
+				files: map[string]string{
+					"/root.crt":      serverCert,
+					"/other.crt":     otherCert,
+					"/localhost.crt": localhostCert,
+					"/client.crt":    clientCert,
+					"/client.key":    clientKey,
+				},
+			}
+
+			client := testServe(t, s)
+			startup := (&startupMessage{map[string]string{"database": "db", "user": "guest"}}).toRaw()
+			if err := startup.write(client); err != nil {
+				t.Fatal(err)
+			}
+
+			ssl := ""
+			for {
+				var pkt rawPacket
+				if err := pkt.read(client, noMessageSizeLimit); err != nil {
+					t.Fatal(err)
+				}
+				if pkt.header == 'S' {
+					ssl = string(pkt.data[len("ssl\x00") : len(pkt.data)-1])
+				}
+				if pkt.header == 'Z' || pkt.header == 'E' {
+					break
+				}
+			}
+			if ssl != test.ssl {
+				t.Fatalf("%q != %q", ssl, test.ssl)
+			}
+		})
+	}
+}